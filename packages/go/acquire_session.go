@@ -12,6 +12,7 @@ import (
 // errors:
 // - ErrSessionNotFound: If no session with the given id is found.
 // - ErrSessionIsOffloading: If the session is offloading and the required permission is read-write.
+// - ErrSessionExpired: If the session is expired.
 func (c *RedisCommands) AcquireSession(ctx context.Context, sessionId string, opt api.AcquireSessionOptions) (*api.SessionLocation, error) {
 	var allow_offloading string
 	if opt.AllowOffloading() {
@@ -27,7 +28,7 @@ func (c *RedisCommands) AcquireSession(ctx context.Context, sessionId string, op
 		allow_while_offloading = "0"
 	}
 
-	res, err := c.client.FCall(ctx, "acquire_session", []string{sessionId}, allow_offloading, allow_while_offloading).StringSlice()
+	res, err := c.fcallSession(ctx, "acquire_session", sessionId, sessionKeys(sessionId), sessionId, allow_offloading, allow_while_offloading).StringSlice()
 
 	if err != nil {
 		return nil, err
@@ -44,6 +45,12 @@ func (c *RedisCommands) AcquireSession(ctx context.Context, sessionId string, op
 	return nil, err
 }
 
+// Releases a previously acquired session. If the session has been offloaded
+// while acquired it returns the new session location, otherwise nil. The
+// options must match the ones used to acquire the session.
+// errors:
+// - ErrSessionNotFound: If no session with the given id is found.
+// - ErrNoAcquisitionToRelease: If the session has no acquisition to release.
 func (c *RedisCommands) ReleaseSession(
 	ctx context.Context,
 	sessionId string,
@@ -56,8 +63,7 @@ func (c *RedisCommands) ReleaseSession(
 		allow_offloading = "0"
 	}
 
-	res, err := c.client.FCall(ctx, "acquire_session", []string{sessionId}, allow_offloading).StringSlice()
-
+	res, err := c.fcallSession(ctx, "release_session", sessionId, sessionKeys(sessionId), sessionId, allow_offloading).StringSlice()
 	if err != nil {
 		return nil, err
 	}
@@ -84,7 +90,7 @@ func (c *RedisCommands) ScanOffloadableSessions(
 	cursor uint64,
 	count int64,
 ) ([]string, uint64, error) {
-	results, newCursor, err := c.client.ZScan(ctx, "c:offloadable_sessions_set", cursor, "*", count).Result()
+	results, newCursor, err := c.client.ZScan(ctx, offloadableSessionsSetKey, cursor, "*", count).Result()
 	if err != nil {
 		return nil, 0, err
 	}
@@ -0,0 +1,70 @@
+package redis_commands
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ermes-labs/api-go/api"
+)
+
+func TestReleaseSession(t *testing.T) {
+	offloadable := api.NewAcquireSessionOptionsBuilder().AllowOffloading().Build()
+	nonOffloadable := api.DefaultAcquireSessionOptions()
+
+	for name, opt := range map[string]api.AcquireSessionOptions{"offloadable": offloadable, "non offloadable": nonOffloadable} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			commands, client := newTestRedisCommands(t)
+
+			sessionId, err := commands.CreateAndAcquireSession(ctx, api.CreateAndAcquireSessionOptions{AcquireSessionOptions: opt})
+
+			if err != nil {
+				t.Fatalf("CreateAndAcquireSession() error = %v", err)
+			}
+
+			if location, err := commands.ReleaseSession(ctx, sessionId, opt); err != nil || location != nil {
+				t.Fatalf("ReleaseSession() = %v, %v, want no location", location, err)
+			}
+
+			// The released session is offloadable again.
+			checkSessionUses(t, client, sessionId, "0", "0", true)
+
+			if _, err := commands.ReleaseSession(ctx, sessionId, opt); !errors.Is(err, api.ErrNoAcquisitionToRelease) {
+				t.Fatalf("ReleaseSession() of a released session error = %v, want %v", err, api.ErrNoAcquisitionToRelease)
+			}
+		})
+	}
+}
+
+func TestReleaseSessionNotFound(t *testing.T) {
+	commands, _ := newTestRedisCommands(t)
+
+	if _, err := commands.ReleaseSession(context.Background(), "missing", api.DefaultAcquireSessionOptions()); !errors.Is(err, api.ErrSessionNotFound) {
+		t.Fatalf("ReleaseSession() of a missing session error = %v, want %v", err, api.ErrSessionNotFound)
+	}
+}
+
+func TestReleaseSessionOffloaded(t *testing.T) {
+	ctx := context.Background()
+	commands, _ := newTestRedisCommands(t)
+	opt := api.NewAcquireSessionOptionsBuilder().AllowOffloading().Build()
+
+	sessionId, err := commands.CreateAndAcquireSession(ctx, api.CreateAndAcquireSessionOptions{AcquireSessionOptions: opt})
+
+	if err != nil {
+		t.Fatalf("CreateAndAcquireSession() error = %v", err)
+	}
+
+	// The session is offloaded while it is acquired in an offloadable way.
+	offloadTestSession(t, commands, sessionId, OffloadOptions{})
+	newLocation := api.NewSessionLocation("host", "session")
+
+	if err := commands.ConfirmSessionOffload(ctx, sessionId, newLocation, api.OffloadSessionOptions{}, nil); err != nil {
+		t.Fatalf("ConfirmSessionOffload() error = %v", err)
+	}
+
+	if location, err := commands.ReleaseSession(ctx, sessionId, opt); err != nil || location == nil || *location != newLocation {
+		t.Fatalf("ReleaseSession() = %v, %v, want %v", location, err, newLocation)
+	}
+}
@@ -0,0 +1,122 @@
+package redis_commands
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/ermes-labs/api-go/api"
+	"github.com/ermes-labs/api-go/infrastructure"
+)
+
+// Some of the options of the api package do not expose an accessor for their
+// fields, the following functions use the accessors if the options have them,
+// as the newer versions of the api package are expected to, and otherwise read
+// the fields through reflection. If a field is renamed or changes type in a
+// newer version of the api package without an accessor, they return
+// ErrIncompatibleOptions instead of ignoring the option.
+
+// The accessors of api.SessionMetadataOptions, as the ones of
+// api.CreateSessionOptions.
+type sessionMetadataOptionsAccessors interface {
+	ClientGeoCoordinates() *infrastructure.GeoCoordinates
+	ExpiresAt() *int64
+	Expired() bool
+}
+
+// The accessors of api.GarbageCollectSessionsOptions.
+type garbageCollectSessionsOptionsAccessors interface {
+	ExpiredUnreleasedOlderThan() *int64
+}
+
+// The types of the fields read through reflection.
+var (
+	int64PointerType          = reflect.TypeOf((*int64)(nil))
+	boolType                  = reflect.TypeOf(false)
+	geoCoordinatesPointerType = reflect.TypeOf((*infrastructure.GeoCoordinates)(nil))
+)
+
+// Returns the field with the given name and type of an options struct.
+func optionsField(options any, name string, fieldType reflect.Type) (reflect.Value, error) {
+	field := reflect.ValueOf(options).FieldByName(name)
+
+	if !field.IsValid() || field.Type() != fieldType {
+		return reflect.Value{}, fmt.Errorf("%w: %T has no field %s of type %s", ErrIncompatibleOptions, options, name, fieldType)
+	}
+
+	return field, nil
+}
+
+// Returns the value of an *int64 field of an options struct, nil if the field
+// is not set.
+func optionsInt64PointerField(options any, name string) (*int64, error) {
+	field, err := optionsField(options, name, int64PointerType)
+
+	if err != nil || field.IsNil() {
+		return nil, err
+	}
+
+	value := field.Elem().Int()
+	return &value, nil
+}
+
+// Returns the value of a bool field of an options struct.
+func optionsBoolField(options any, name string) (bool, error) {
+	field, err := optionsField(options, name, boolType)
+
+	if err != nil {
+		return false, err
+	}
+
+	return field.Bool(), nil
+}
+
+// Returns the client geo coordinates to set in the session metadata, nil if
+// they must not be changed.
+func clientGeoCoordinates(opt api.SessionMetadataOptions) (*infrastructure.GeoCoordinates, error) {
+	if accessors, ok := any(opt).(sessionMetadataOptionsAccessors); ok {
+		return accessors.ClientGeoCoordinates(), nil
+	}
+
+	field, err := optionsField(opt, "clientGeoCoordinates", geoCoordinatesPointerType)
+
+	if err != nil || field.IsNil() {
+		return nil, err
+	}
+
+	// Fields read from an unexported field cannot be converted back with
+	// Interface, so the struct is copied field by field.
+	coordinates := field.Elem()
+	return &infrastructure.GeoCoordinates{
+		Latitude:  coordinates.FieldByName("Latitude").Float(),
+		Longitude: coordinates.FieldByName("Longitude").Float(),
+	}, nil
+}
+
+// Returns the expiration time to set in the session metadata, nil if it must
+// not be changed.
+func sessionExpiresAt(opt api.SessionMetadataOptions) (*int64, error) {
+	if accessors, ok := any(opt).(sessionMetadataOptionsAccessors); ok {
+		return accessors.ExpiresAt(), nil
+	}
+
+	return optionsInt64PointerField(opt, "expiresAt")
+}
+
+// Returns true if the session must be marked as expired.
+func sessionExpired(opt api.SessionMetadataOptions) (bool, error) {
+	if accessors, ok := any(opt).(sessionMetadataOptionsAccessors); ok {
+		return accessors.Expired(), nil
+	}
+
+	return optionsBoolField(opt, "expired")
+}
+
+// Returns the number of seconds after the expiration after which expired but
+// unreleased sessions are garbage collected, nil if they are never collected.
+func expiredUnreleasedOlderThan(opt api.GarbageCollectSessionsOptions) (*int64, error) {
+	if accessors, ok := any(opt).(garbageCollectSessionsOptionsAccessors); ok {
+		return accessors.ExpiredUnreleasedOlderThan(), nil
+	}
+
+	return optionsInt64PointerField(opt, "expiredUnreleasedOlderThan")
+}
@@ -0,0 +1,59 @@
+package redis_commands
+
+import (
+	"testing"
+
+	"github.com/ermes-labs/api-go/api"
+	"github.com/ermes-labs/api-go/infrastructure"
+)
+
+// The options built with the builders of the api package are read back, so that
+// a change of the api package that breaks the reflection fails here.
+func TestSessionMetadataOptions(t *testing.T) {
+	coordinates := infrastructure.GeoCoordinates{Latitude: 45, Longitude: 9}
+	opt := api.NewSessionMetadataOptionsBuilder().
+		ClientGeoCoordinates(coordinates).
+		UnixExpiresAt(1700000000).
+		MarkExpired().
+		Build()
+
+	if got, err := clientGeoCoordinates(opt); err != nil || got == nil || *got != coordinates {
+		t.Fatalf("clientGeoCoordinates() = %v, %v, want %v", got, err, coordinates)
+	}
+
+	if got, err := sessionExpiresAt(opt); err != nil || got == nil || *got != 1700000000 {
+		t.Fatalf("sessionExpiresAt() = %v, %v, want 1700000000", got, err)
+	}
+
+	if got, err := sessionExpired(opt); err != nil || !got {
+		t.Fatalf("sessionExpired() = %v, %v, want true", got, err)
+	}
+
+	empty := api.NewSessionMetadataOptionsBuilder().Build()
+
+	if got, err := clientGeoCoordinates(empty); err != nil || got != nil {
+		t.Fatalf("clientGeoCoordinates() of empty options = %v, %v, want nil", got, err)
+	}
+
+	if got, err := sessionExpiresAt(empty); err != nil || got != nil {
+		t.Fatalf("sessionExpiresAt() of empty options = %v, %v, want nil", got, err)
+	}
+
+	if got, err := sessionExpired(empty); err != nil || got {
+		t.Fatalf("sessionExpired() of empty options = %v, %v, want false", got, err)
+	}
+}
+
+func TestGarbageCollectSessionsOptions(t *testing.T) {
+	opt := api.NewGarbageCollectSessionsOptionsBuilder().
+		CollectExpiredButUnreleasedOlderThanUnix(1700000000).
+		Build()
+
+	if got, err := expiredUnreleasedOlderThan(opt); err != nil || got == nil || *got != 1700000000 {
+		t.Fatalf("expiredUnreleasedOlderThan() = %v, %v, want 1700000000", got, err)
+	}
+
+	if got, err := expiredUnreleasedOlderThan(api.NewGarbageCollectSessionsOptionsBuilder().Build()); err != nil || got != nil {
+		t.Fatalf("expiredUnreleasedOlderThan() of empty options = %v, %v, want nil", got, err)
+	}
+}
@@ -2,49 +2,324 @@ package redis_commands
 
 import (
 	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
 
 	"github.com/ermes-labs/api-go/api"
 	"github.com/ermes-labs/api-go/infrastructure"
 )
 
+// Weights of the criteria used to rank the sessions to offload, they sum to 1.
+const (
+	idlenessWeight       = 0.4
+	clientDistanceWeight = 0.3
+	resourcesUsageWeight = 0.3
+)
+
+// Half-saturation constants of the criteria used to rank the sessions to
+// offload: a session idle for idlenessScale seconds, or whose client is
+// clientDistanceScale km away from the node, scores half of the maximum.
+const (
+	idlenessScale       = 300.0
+	clientDistanceScale = 100.0
+)
+
+// The number of candidates considered for each session to return.
+const candidatesPerTarget = 4
+
 // Return the best sessions to offload. This list is composed by the session
 // chosen given the local context of the node (direct or indirect knowledge of
-// the status of the system).
+// the status of the system). The candidates are the most idle sessions that can
+// be offloaded, ranked combining how long they have been idle, how far their
+// client is from the current node and their share of the resources usage of the
+// current node.
 func (c *RedisCommands) BestSessionsToOffload(
 	ctx context.Context,
 	opt api.BestOffloadTargetsOptions,
 ) (sessions map[string]api.SessionInfoForOffloadDecision, err error) {
-	return nil, nil
+	if opt.MaxTargets <= 0 {
+		return map[string]api.SessionInfoForOffloadDecision{}, nil
+	}
+
+	res, err := c.fcall(ctx, "offload_candidates", nodeUsageKeys(sessionsIndexKeys(nodesGeosetKey)...), opt.MaxTargets*candidatesPerTarget).Slice()
+
+	if err != nil {
+		return nil, err
+	}
+
+	now := res[0].(int64)
+	nodeCoordinates, err := parseGeoCoordinates(res[1].([]interface{})[0].(string), res[1].([]interface{})[1].(string))
+
+	if err != nil {
+		return nil, err
+	}
+
+	nodeResourcesUsage, err := parseResourcesUsage(toStringSlice(res[2]))
+
+	if err != nil {
+		return nil, err
+	}
+
+	type candidate struct {
+		id    string
+		info  api.SessionInfoForOffloadDecision
+		score float64
+	}
+
+	candidates := make([]candidate, 0, len(res[3].([]interface{})))
+
+	for _, entry := range res[3].([]interface{}) {
+		fields := entry.([]interface{})
+		metadata := toStringSlice(fields[:7])
+		info := api.SessionInfoForOffloadDecision{
+			Metadata: api.SessionMetadata{CreatedIn: metadata[3]},
+		}
+
+		if info.Metadata.ClientGeoCoordinates, err = parseGeoCoordinates(metadata[1], metadata[2]); err != nil {
+			return nil, err
+		}
+
+		if info.Metadata.CreatedAt, err = strconv.ParseInt(metadata[4], 10, 64); err != nil {
+			return nil, err
+		}
+
+		if info.Metadata.UpdatedAt, err = strconv.ParseInt(metadata[5], 10, 64); err != nil {
+			return nil, err
+		}
+
+		if info.Metadata.ExpiresAt, err = parseUnixTimestamp(metadata[6]); err != nil {
+			return nil, err
+		}
+
+		if info.ResourcesUsage, err = parseResourcesUsage(toStringSlice(fields[7])); err != nil {
+			return nil, err
+		}
+
+		candidates = append(candidates, candidate{
+			id:    metadata[0],
+			info:  info,
+			score: offloadScore(now, nodeCoordinates, nodeResourcesUsage, info),
+		})
+	}
+
+	// Keep the candidates with the highest score.
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].score > candidates[j].score
+	})
+
+	sessions = make(map[string]api.SessionInfoForOffloadDecision, min(len(candidates), opt.MaxTargets))
+	for _, candidate := range candidates[:min(len(candidates), opt.MaxTargets)] {
+		sessions[candidate.id] = candidate.info
+	}
+
+	return sessions, nil
+}
+
+// Score a session for offloading, the higher the better. Each criterion is
+// normalized in [0, 1), criteria that cannot be evaluated score 0.
+func offloadScore(
+	now int64,
+	nodeCoordinates *infrastructure.GeoCoordinates,
+	nodeResourcesUsage api.ResourcesUsage,
+	info api.SessionInfoForOffloadDecision,
+) float64 {
+	idleness := saturate(float64(now-info.Metadata.UpdatedAt), idlenessScale)
+
+	clientDistance := 0.0
+	if nodeCoordinates != nil && info.Metadata.ClientGeoCoordinates != nil {
+		clientDistance = saturate(distanceKm(*nodeCoordinates, *info.Metadata.ClientGeoCoordinates), clientDistanceScale)
+	}
+
+	// The average share of the resources of the node used by the session.
+	resourcesUsage := 0.0
+	if len(info.ResourcesUsage) > 0 {
+		for resource, usage := range info.ResourcesUsage {
+			if total := nodeResourcesUsage[resource]; total > 0 {
+				resourcesUsage += math.Min(usage/total, 1)
+			}
+		}
+		resourcesUsage /= float64(len(info.ResourcesUsage))
+	}
+
+	return idlenessWeight*idleness +
+		clientDistanceWeight*clientDistance +
+		resourcesUsageWeight*resourcesUsage
+}
+
+// Map a non-negative value in [0, 1), the value scale maps to 0.5.
+func saturate(value float64, scale float64) float64 {
+	if value <= 0 {
+		return 0
+	}
+
+	return value / (value + scale)
+}
+
+// The radius of the Earth in km.
+const earthRadiusKm = 6371.0
+
+// Return the great-circle distance in km between two coordinates.
+func distanceKm(from infrastructure.GeoCoordinates, to infrastructure.GeoCoordinates) float64 {
+	lat1, lat2 := from.Latitude*math.Pi/180, to.Latitude*math.Pi/180
+	deltaLat := lat2 - lat1
+	deltaLong := (to.Longitude - from.Longitude) * math.Pi / 180
+
+	a := math.Sin(deltaLat/2)*math.Sin(deltaLat/2) +
+		math.Cos(lat1)*math.Cos(lat2)*math.Sin(deltaLong/2)*math.Sin(deltaLong/2)
+
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(a))
 }
 
 // Return the best offload targets composed by the session id and the node id.
 // The options defines how the sessions are selected. Note that sessions and
 // nodes may appear multiple times in the result, to allow for multiple choices
 // of offload targets. those are not grouped by session id or node id to allow
-// to express the priority of the offload targets.
+// to express the priority of the offload targets. The candidates of each
+// session are the nodes closer to its client than the given node, then the
+// siblings of the node and finally its parent, ordered by distance from the
+// client. Nodes that lack the capacity to host a session, given their last
+// known resources usage, are discarded.
+// errors:
+// - ErrNodeNotFound: If no node with the given id is found.
 func (c *RedisCommands) BestOffloadTargetNodes(
 	ctx context.Context,
 	nodeId string,
 	sessions map[string]api.SessionInfoForOffloadDecision,
 	opt api.BestOffloadTargetsOptions,
 ) ([][2]string, error) {
-	return nil, nil
+	if opt.MaxTargets <= 0 || len(sessions) == 0 {
+		return [][2]string{}, nil
+	}
+
+	args := make([]interface{}, 0, 1+3*len(sessions))
+	args = append(args, nodeId)
+	for sessionId, info := range sessions {
+		latitude, longitude := formatGeoCoordinates(info.Metadata.ClientGeoCoordinates)
+		args = append(args, sessionId, latitude, longitude)
+	}
+
+	res, err := c.fcall(ctx, "offload_target_candidates",
+		nodeUsageKeys(infrastructureKeys()...), args...).Slice()
+
+	if err != nil {
+		return nil, err
+	}
+
+	// The candidate nodes and their last known resources usage.
+	type candidateNode struct {
+		node           *infrastructure.Node
+		resourcesUsage api.ResourcesUsage
+	}
+
+	nodes := make(map[string]candidateNode)
+
+	for _, entry := range res[1].([]interface{}) {
+		fields := entry.([]interface{})
+		node, err := infrastructure.UnmarshalNode([]byte(fields[1].(string)))
+
+		if err != nil {
+			return nil, err
+		}
+
+		resourcesUsage, err := parseResourcesUsage(toStringSlice(fields[2]))
+
+		if err != nil {
+			return nil, err
+		}
+
+		nodes[fields[0].(string)] = candidateNode{node: node, resourcesUsage: resourcesUsage}
+	}
+
+	type target struct {
+		sessionId string
+		nodeId    string
+		tier      int64
+		distance  float64
+	}
+
+	targets := make([]target, 0, len(res[0].([]interface{})))
+
+	for _, entry := range res[0].([]interface{}) {
+		fields := entry.([]interface{})
+		sessionId, nodeId := fields[0].(string), fields[1].(string)
+		distance, err := strconv.ParseFloat(fields[3].(string), 64)
+
+		if err != nil {
+			return nil, err
+		}
+
+		node := nodes[nodeId]
+		if !hasCapacity(node.node.Resources, node.resourcesUsage, sessions[sessionId].ResourcesUsage) {
+			continue
+		}
+
+		targets = append(targets, target{sessionId, nodeId, fields[2].(int64), distance})
+	}
+
+	// Sort by tier, then by distance from the client.
+	sort.SliceStable(targets, func(i, j int) bool {
+		if targets[i].tier != targets[j].tier {
+			return targets[i].tier < targets[j].tier
+		}
+
+		return targets[i].distance < targets[j].distance
+	})
+
+	pairs := make([][2]string, 0, min(len(targets), opt.MaxTargets))
+	for _, target := range targets[:min(len(targets), opt.MaxTargets)] {
+		pairs = append(pairs, [2]string{target.sessionId, target.nodeId})
+	}
+
+	return pairs, nil
+}
+
+// Return true if a node with the given resources and resources usage can host
+// a session with the given resources usage, a node that exhausted one of its
+// resources cannot host any session. Resources that the node does not declare
+// are not limited.
+func hasCapacity(
+	resources infrastructure.Resources,
+	nodeResourcesUsage api.ResourcesUsage,
+	sessionResourcesUsage api.ResourcesUsage,
+) bool {
+	for resource, capacity := range resources {
+		used := nodeResourcesUsage[resource]
+
+		if used >= capacity || used+sessionResourcesUsage[resource] > capacity {
+			return false
+		}
+	}
+
+	return true
 }
 
-// Get the lookup node for a session offloading.
+// Get the lookup node for a session offloading, that is the lowest node of the
+// infrastructure whose subtree covers the nodes closest to the clients of all
+// the given sessions.
+// errors:
+// - ErrInvalidArgument: If no session is given.
+// - ErrSessionNotFound: If no session with one of the given ids is found.
+// - ErrNodeNotFound: If no node covers all the sessions.
 func (c *RedisCommands) FindLookupNode(
 	ctx context.Context,
 	sessionIds []string,
 ) (infrastructure.Node, error) {
-	// FIXME: Implement this function correctly.
-	nodeJson, err := c.client.FCall(ctx, "find_lookup_node", []string{sessionIds[0]}).Text()
+	if len(sessionIds) == 0 {
+		return infrastructure.Node{}, fmt.Errorf("%w: no session given", ErrInvalidArgument)
+	}
 
-	if err != nil {
-		return infrastructure.Node{}, err
+	args := make([]interface{}, 0, len(sessionIds))
+	for _, sessionId := range sessionIds {
+		args = append(args, sessionId)
 	}
 
-	if nodeJson == "" {
-		return infrastructure.Node{}, nil
+	keys := sessionsIndexKeys(infrastructureKeys(currentNodeKey)...)
+	nodeJson, err := c.fcall(ctx, "find_lookup_node", keys, args...).Text()
+
+	if err != nil {
+		return infrastructure.Node{}, err
 	}
 
 	node, err := infrastructure.UnmarshalNode([]byte(nodeJson))
@@ -54,5 +329,4 @@ func (c *RedisCommands) FindLookupNode(
 	}
 
 	return *node, nil
-
 }
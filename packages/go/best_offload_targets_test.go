@@ -0,0 +1,256 @@
+package redis_commands
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/ermes-labs/api-go/api"
+	"github.com/ermes-labs/api-go/infrastructure"
+)
+
+// The tolerance of the comparisons of the scores.
+const scoreTolerance = 1e-9
+
+func TestSaturate(t *testing.T) {
+	tests := []struct {
+		name  string
+		value float64
+		scale float64
+		want  float64
+	}{
+		{"negative", -10, 100, 0},
+		{"zero", 0, 100, 0},
+		{"scale", 100, 100, 0.5},
+		{"three times the scale", 300, 100, 0.75},
+		{"huge", 1e12, 100, 1 - 1e-10},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := saturate(test.value, test.scale); math.Abs(got-test.want) > scoreTolerance {
+				t.Fatalf("saturate(%v, %v) = %v, want %v", test.value, test.scale, got, test.want)
+			}
+		})
+	}
+}
+
+func TestDistanceKm(t *testing.T) {
+	tests := []struct {
+		name string
+		from infrastructure.GeoCoordinates
+		to   infrastructure.GeoCoordinates
+		want float64
+	}{
+		{"same point", infrastructure.GeoCoordinates{Latitude: 45, Longitude: 9}, infrastructure.GeoCoordinates{Latitude: 45, Longitude: 9}, 0},
+		{"one degree of latitude", infrastructure.GeoCoordinates{}, infrastructure.GeoCoordinates{Latitude: 1}, earthRadiusKm * math.Pi / 180},
+		{"antipodes", infrastructure.GeoCoordinates{}, infrastructure.GeoCoordinates{Longitude: 180}, earthRadiusKm * math.Pi},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := distanceKm(test.from, test.to); math.Abs(got-test.want) > 1e-6 {
+				t.Fatalf("distanceKm() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestOffloadScore(t *testing.T) {
+	const now = 1000
+	node := &infrastructure.GeoCoordinates{Latitude: 0, Longitude: 0}
+	// A client at the distance that maps to 0.5.
+	client := &infrastructure.GeoCoordinates{Latitude: clientDistanceScale / (earthRadiusKm * math.Pi / 180)}
+
+	tests := []struct {
+		name               string
+		nodeCoordinates    *infrastructure.GeoCoordinates
+		nodeResourcesUsage api.ResourcesUsage
+		info               api.SessionInfoForOffloadDecision
+		want               float64
+	}{
+		{
+			name: "just used",
+			info: api.SessionInfoForOffloadDecision{Metadata: api.SessionMetadata{UpdatedAt: now}},
+			want: 0,
+		},
+		{
+			name: "updated in the future",
+			info: api.SessionInfoForOffloadDecision{Metadata: api.SessionMetadata{UpdatedAt: now + 10}},
+			want: 0,
+		},
+		{
+			name: "idle",
+			info: api.SessionInfoForOffloadDecision{Metadata: api.SessionMetadata{UpdatedAt: now - idlenessScale}},
+			want: idlenessWeight * 0.5,
+		},
+		{
+			name:            "distant client",
+			nodeCoordinates: node,
+			info:            api.SessionInfoForOffloadDecision{Metadata: api.SessionMetadata{UpdatedAt: now, ClientGeoCoordinates: client}},
+			want:            clientDistanceWeight * 0.5,
+		},
+		{
+			name: "node without coordinates",
+			info: api.SessionInfoForOffloadDecision{Metadata: api.SessionMetadata{UpdatedAt: now, ClientGeoCoordinates: client}},
+			want: 0,
+		},
+		{
+			name:            "client without coordinates",
+			nodeCoordinates: node,
+			info:            api.SessionInfoForOffloadDecision{Metadata: api.SessionMetadata{UpdatedAt: now}},
+			want:            0,
+		},
+		{
+			name:               "resources usage",
+			nodeResourcesUsage: api.ResourcesUsage{"cpu": 4, "memory": 100},
+			info: api.SessionInfoForOffloadDecision{
+				Metadata:       api.SessionMetadata{UpdatedAt: now},
+				ResourcesUsage: api.ResourcesUsage{"cpu": 1, "memory": 50},
+			},
+			want: resourcesUsageWeight * (0.25 + 0.5) / 2,
+		},
+		{
+			name:               "resources usage above the one of the node",
+			nodeResourcesUsage: api.ResourcesUsage{"cpu": 1},
+			info: api.SessionInfoForOffloadDecision{
+				Metadata:       api.SessionMetadata{UpdatedAt: now},
+				ResourcesUsage: api.ResourcesUsage{"cpu": 2},
+			},
+			want: resourcesUsageWeight,
+		},
+		{
+			name:               "resources unknown to the node",
+			nodeResourcesUsage: api.ResourcesUsage{"cpu": 4},
+			info: api.SessionInfoForOffloadDecision{
+				Metadata:       api.SessionMetadata{UpdatedAt: now},
+				ResourcesUsage: api.ResourcesUsage{"cpu": 2, "gpu": 1},
+			},
+			want: resourcesUsageWeight * 0.5 / 2,
+		},
+		{
+			name:               "every criterion",
+			nodeCoordinates:    node,
+			nodeResourcesUsage: api.ResourcesUsage{"cpu": 4},
+			info: api.SessionInfoForOffloadDecision{
+				Metadata:       api.SessionMetadata{UpdatedAt: now - idlenessScale, ClientGeoCoordinates: client},
+				ResourcesUsage: api.ResourcesUsage{"cpu": 1},
+			},
+			want: idlenessWeight*0.5 + clientDistanceWeight*0.5 + resourcesUsageWeight*0.25,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := offloadScore(now, test.nodeCoordinates, test.nodeResourcesUsage, test.info)
+
+			if math.Abs(got-test.want) > scoreTolerance {
+				t.Fatalf("offloadScore() = %v, want %v", got, test.want)
+			}
+
+			if got < 0 || got >= 1 {
+				t.Fatalf("offloadScore() = %v, want a score in [0, 1)", got)
+			}
+		})
+	}
+}
+
+func TestHasCapacity(t *testing.T) {
+	tests := []struct {
+		name                  string
+		resources             infrastructure.Resources
+		nodeResourcesUsage    api.ResourcesUsage
+		sessionResourcesUsage api.ResourcesUsage
+		want                  bool
+	}{
+		{"no resources declared", nil, api.ResourcesUsage{"cpu": 100}, api.ResourcesUsage{"cpu": 100}, true},
+		{"no usage reported", infrastructure.Resources{"cpu": 4}, nil, api.ResourcesUsage{"cpu": 1}, true},
+		{"fits", infrastructure.Resources{"cpu": 4}, api.ResourcesUsage{"cpu": 2}, api.ResourcesUsage{"cpu": 1}, true},
+		{"fits exactly", infrastructure.Resources{"cpu": 4}, api.ResourcesUsage{"cpu": 3}, api.ResourcesUsage{"cpu": 1}, true},
+		{"does not fit", infrastructure.Resources{"cpu": 4}, api.ResourcesUsage{"cpu": 3}, api.ResourcesUsage{"cpu": 2}, false},
+		{"exhausted", infrastructure.Resources{"cpu": 4}, api.ResourcesUsage{"cpu": 4}, nil, false},
+		{"over capacity", infrastructure.Resources{"cpu": 4}, api.ResourcesUsage{"cpu": 5}, nil, false},
+		{"one resource does not fit", infrastructure.Resources{"cpu": 4, "memory": 10}, api.ResourcesUsage{"cpu": 1, "memory": 9}, api.ResourcesUsage{"cpu": 1, "memory": 2}, false},
+		{"undeclared resource", infrastructure.Resources{"cpu": 4}, api.ResourcesUsage{"gpu": 100}, api.ResourcesUsage{"cpu": 1, "gpu": 100}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := hasCapacity(test.resources, test.nodeResourcesUsage, test.sessionResourcesUsage); got != test.want {
+				t.Fatalf("hasCapacity() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// An infrastructure with two areas under the root, each one with a leaf.
+const testLookupInfrastructureJson = `{"areaIdentifiers":["region","zone","site"],"areas":[
+	{"areaName":"root","host":"root.test","geoCoordinates":{"latitude":45,"longitude":9},"areas":[
+		{"areaName":"north","host":"north.test","geoCoordinates":{"latitude":46,"longitude":9},"areas":[
+			{"areaName":"north-leaf","host":"north-leaf.test","geoCoordinates":{"latitude":46.5,"longitude":9}}]},
+		{"areaName":"south","host":"south.test","geoCoordinates":{"latitude":44,"longitude":9},"areas":[
+			{"areaName":"south-leaf","host":"south-leaf.test","geoCoordinates":{"latitude":43.5,"longitude":9}}]}]}]}`
+
+func TestFindLookupNode(t *testing.T) {
+	ctx := context.Background()
+	commands, _ := newTestRedisCommands(t)
+	loadTestInfrastructureJson(t, commands, testLookupInfrastructureJson)
+
+	// Creates a session with a client near the given coordinates.
+	createSession := func(latitude float64) string {
+		coordinates := infrastructure.GeoCoordinates{Latitude: latitude, Longitude: 9}
+		sessionId, err := commands.CreateSession(ctx, api.NewCreateSessionOptionsBuilder().ClientGeoCoordinates(coordinates).Build())
+
+		if err != nil {
+			t.Fatalf("CreateSession() error = %v", err)
+		}
+
+		return sessionId
+	}
+
+	north, otherNorth, south := createSession(46.6), createSession(46.4), createSession(43.4)
+
+	tests := []struct {
+		name       string
+		sessionIds []string
+		want       string
+		wantErr    error
+	}{
+		{"single session", []string{north}, "north", nil},
+		{"sessions in the same area", []string{north, otherNorth}, "north", nil},
+		{"sessions in different areas", []string{north, south}, "root", nil},
+		{"no session", nil, "", ErrInvalidArgument},
+		{"missing session", []string{north, "missing"}, "", api.ErrSessionNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			node, err := commands.FindLookupNode(ctx, test.sessionIds)
+
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("FindLookupNode() error = %v, want %v", err, test.wantErr)
+			}
+
+			if test.wantErr == nil && node.AreaName != test.want {
+				t.Fatalf("FindLookupNode() = %s, want %s", node.AreaName, test.want)
+			}
+		})
+	}
+}
+
+func TestFindLookupNodeWithoutInfrastructure(t *testing.T) {
+	ctx := context.Background()
+	commands, _ := newTestRedisCommands(t)
+	coordinates := infrastructure.GeoCoordinates{Latitude: 45, Longitude: 9}
+
+	sessionId, err := commands.CreateSession(ctx, api.NewCreateSessionOptionsBuilder().ClientGeoCoordinates(coordinates).Build())
+
+	if err != nil {
+		t.Fatalf("CreateSession() error = %v", err)
+	}
+
+	if _, err := commands.FindLookupNode(ctx, []string{sessionId}); !errors.Is(err, ErrNodeNotFound) {
+		t.Fatalf("FindLookupNode() error = %v, want %v", err, ErrNodeNotFound)
+	}
+}
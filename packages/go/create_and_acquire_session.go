@@ -6,10 +6,20 @@ import (
 	"github.com/ermes-labs/api-go/api"
 )
 
-// Creates a new session and acquires it. Returns the id of the session.
+// Creates a new session and acquires it. Returns the id of the session. The
+// session is created already acquired, so that it is never visible as an
+// unacquired session before the first request uses it.
+// errors:
+// - ErrSessionIdAlreadyExists: If a session with the given id already exists.
+// - ErrNoCurrentNode: If the id of the current node is not set.
 func (c *RedisCommands) CreateAndAcquireSession(
 	ctx context.Context,
 	options api.CreateAndAcquireSessionOptions,
 ) (string, error) {
-	return "", nil
+	acquire := "non-offloadable"
+	if options.AllowOffloading() {
+		acquire = "offloadable"
+	}
+
+	return c.createSession(ctx, options.CreateSessionOptions, acquire)
 }
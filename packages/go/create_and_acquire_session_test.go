@@ -0,0 +1,113 @@
+package redis_commands
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/ermes-labs/api-go/api"
+	"github.com/redis/go-redis/v9"
+)
+
+// Checks the uses of a session and whether it is offloadable.
+func checkSessionUses(t *testing.T, client redis.UniversalClient, sessionId string, nonOffloadable string, offloadable string, wantOffloadable bool) {
+	t.Helper()
+
+	ctx := context.Background()
+	uses := client.HMGet(ctx, sessionMetadataKey(sessionId), "non_offloadable_uses", "offloadable_uses").Val()
+
+	if want := []interface{}{nonOffloadable, offloadable}; !reflect.DeepEqual(uses, want) {
+		t.Errorf("uses = %v, want %v", uses, want)
+	}
+
+	if err := client.ZScore(ctx, offloadableSessionsSetKey, sessionId).Err(); (err == nil) != wantOffloadable {
+		t.Errorf("ZScore() of the offloadable sessions error = %v, want offloadable %v", err, wantOffloadable)
+	}
+}
+
+func TestCreateSession(t *testing.T) {
+	ctx := context.Background()
+	commands, client := newTestRedisCommands(t)
+
+	sessionId, err := commands.CreateSession(ctx, api.NewCreateSessionOptionsBuilder().SessionId("a").Build())
+
+	if err != nil || sessionId != "a" {
+		t.Fatalf("CreateSession() = %q, %v, want %q", sessionId, err, "a")
+	}
+
+	metadata, err := commands.GetSessionMetadata(ctx, sessionId)
+
+	if err != nil || metadata.CreatedIn != testNodeId {
+		t.Fatalf("GetSessionMetadata() = %+v, %v, want a session created in %s", metadata, err, testNodeId)
+	}
+
+	checkSessionUses(t, client, sessionId, "0", "0", true)
+
+	if _, err := commands.CreateSession(ctx, api.NewCreateSessionOptionsBuilder().SessionId("a").Build()); !errors.Is(err, api.ErrSessionIdAlreadyExists) {
+		t.Fatalf("CreateSession() of an existing id error = %v, want %v", err, api.ErrSessionIdAlreadyExists)
+	}
+
+	client.Del(ctx, currentNodeKey)
+
+	if _, err := commands.CreateSession(ctx, api.DefaultCreateSessionOptions()); !errors.Is(err, ErrNoCurrentNode) {
+		t.Fatalf("CreateSession() without a current node error = %v, want %v", err, ErrNoCurrentNode)
+	}
+}
+
+func TestCreateAndAcquireSession(t *testing.T) {
+	tests := []struct {
+		name            string
+		options         api.CreateAndAcquireSessionOptions
+		nonOffloadable  string
+		offloadable     string
+		wantOffloadable bool
+	}{
+		{"non offloadable", api.DefaultCreateAndAcquireSessionOptions(), "1", "0", false},
+		{"offloadable", api.CreateAndAcquireSessionOptions{AcquireSessionOptions: api.NewAcquireSessionOptionsBuilder().AllowOffloading().Build()}, "0", "1", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			commands, client := newTestRedisCommands(t)
+
+			sessionId, err := commands.CreateAndAcquireSession(ctx, test.options)
+
+			if err != nil {
+				t.Fatalf("CreateAndAcquireSession() error = %v", err)
+			}
+
+			// The session is acquired as soon as it is created.
+			checkSessionUses(t, client, sessionId, test.nonOffloadable, test.offloadable, test.wantOffloadable)
+		})
+	}
+}
+
+func TestAcquireSession(t *testing.T) {
+	ctx := context.Background()
+	commands, client := newTestRedisCommands(t)
+
+	sessionId, err := commands.CreateSession(ctx, api.DefaultCreateSessionOptions())
+
+	if err != nil {
+		t.Fatalf("CreateSession() error = %v", err)
+	}
+
+	if location, err := commands.AcquireSession(ctx, sessionId, api.NewAcquireSessionOptionsBuilder().AllowOffloading().Build()); err != nil || location != nil {
+		t.Fatalf("AcquireSession() = %v, %v, want no location", location, err)
+	}
+
+	checkSessionUses(t, client, sessionId, "0", "1", true)
+
+	if _, err := commands.AcquireSession(ctx, sessionId, api.DefaultAcquireSessionOptions()); err != nil {
+		t.Fatalf("AcquireSession() error = %v", err)
+	}
+
+	// A non offloadable use makes the session not offloadable.
+	checkSessionUses(t, client, sessionId, "1", "1", false)
+
+	if _, err := commands.AcquireSession(ctx, "missing", api.DefaultAcquireSessionOptions()); !errors.Is(err, api.ErrSessionNotFound) {
+		t.Fatalf("AcquireSession() of a missing session error = %v, want %v", err, api.ErrSessionNotFound)
+	}
+}
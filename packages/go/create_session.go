@@ -2,30 +2,39 @@ package redis_commands
 
 import (
 	"context"
-	"strconv"
 
 	"github.com/ermes-labs/api-go/api"
 	"github.com/google/uuid"
 )
 
 // Creates a new session and returns the id of the session.
+// errors:
+// - ErrSessionIdAlreadyExists: If a session with the given id already exists.
+// - ErrNoCurrentNode: If the id of the current node is not set.
 func (c *RedisCommands) CreateSession(
 	ctx context.Context,
 	opt api.CreateSessionOptions,
 ) (string, error) {
-	clientGeoCoordinates := opt.ClientGeoCoordinates()
-	var latitude, longitude = "", ""
-	if clientGeoCoordinates != nil {
-		latitude = strconv.FormatFloat(clientGeoCoordinates.Latitude, 'f', 6, 64)
-		longitude = strconv.FormatFloat(clientGeoCoordinates.Longitude, 'f', 6, 64)
-	}
+	return c.createSession(ctx, opt, "")
+}
 
-	expiresAt := ""
-	if opt.ExpiresAt() != nil {
-		expiresAt = strconv.FormatInt(*opt.ExpiresAt(), 10)
-	}
+// Creates a new session and returns the id of the session. The acquire
+// parameter defines how the session is acquired in the same call that creates
+// it, it can be "offloadable", "non-offloadable" or "" to not acquire it.
+func (c *RedisCommands) createSession(
+	ctx context.Context,
+	opt api.CreateSessionOptions,
+	acquire string,
+) (string, error) {
+	latitude, longitude := formatGeoCoordinates(opt.ClientGeoCoordinates())
+	expiresAt := formatUnixTimestamp(opt.ExpiresAt())
+
+	// The session is created in the current node.
+	createdIn, err := c.GetCurrentNode(ctx)
 
-	acquire := ""
+	if err != nil {
+		return "", err
+	}
 
 	for {
 		var sessionId string
@@ -35,14 +44,17 @@ func (c *RedisCommands) CreateSession(
 			sessionId = *opt.SessionId()
 		}
 
-		res, err := c.client.FCall(ctx, "create_session", []string{sessionId},
+		res, err := c.fcallSession(ctx, "create_session", sessionId, sessionKeys(sessionId),
+			sessionId,
 			latitude,
 			longitude,
 			expiresAt,
-			acquire).Bool()
+			acquire,
+			createdIn,
+			formatFlag(c.options.indexSessionKeys)).Bool()
 
 		if err != nil {
-			return "nil", err
+			return "", err
 		}
 
 		if res {
@@ -59,7 +71,7 @@ func (c *RedisCommands) ScanSessions(
 	cursor uint64,
 	count int64,
 ) ([]string, uint64, error) {
-	results, newCursor, err := c.client.ZScan(ctx, "c:sessions_set", cursor, "*", count).Result()
+	results, newCursor, err := c.client.ZScan(ctx, sessionsSetKey, cursor, "*", count).Result()
 	if err != nil {
 		return nil, 0, err
 	}
@@ -0,0 +1,23 @@
+package redis_commands
+
+import (
+	"context"
+)
+
+// Deletes a session, its data is deleted chunk by chunk to avoid blocking the
+// server. Once the deletion started, the session cannot be used anymore.
+// errors:
+// - ErrSessionNotFound: If no session with the given id is found.
+// - ErrSessionIsAcquired: If the session is acquired.
+// - ErrSessionIsOffloading: If the session is offloading.
+// - ErrSessionIsOnloading: If the session is onloading.
+func (c *RedisCommands) DeleteSession(
+	ctx context.Context,
+	sessionId string,
+) error {
+	if err := c.fcallSession(ctx, "delete_start", sessionId, sessionKeys(sessionId), sessionId).Err(); err != nil {
+		return err
+	}
+
+	return c.deleteSessionData(ctx, sessionId)
+}
@@ -0,0 +1,149 @@
+package redis_commands
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+
+	"github.com/ermes-labs/api-go/api"
+)
+
+func TestDeleteSession(t *testing.T) {
+	for _, indexed := range []bool{false, true} {
+		t.Run("indexed "+strconv.FormatBool(indexed), func(t *testing.T) {
+			ctx := context.Background()
+			commands, client := newTestRedisCommandsWithOptions(t, NewRedisCommandsOptionsBuilder().IndexSessionKeys(indexed).Build())
+
+			sessionId, err := commands.CreateSession(ctx, api.DefaultCreateSessionOptions())
+
+			if err != nil {
+				t.Fatalf("CreateSession() error = %v", err)
+			}
+
+			// The data spans multiple chunks.
+			for i := 0; i < 2*sessionDataScanCount+sessionDataScanCount/2; i++ {
+				if err := commands.SessionDataCommand(ctx, sessionId, "SET", strconv.Itoa(i), "value").Err(); err != nil {
+					t.Fatalf("SessionDataCommand() error = %v", err)
+				}
+			}
+
+			if err := commands.DeleteSession(ctx, sessionId); err != nil {
+				t.Fatalf("DeleteSession() error = %v", err)
+			}
+
+			if keys := client.Keys(ctx, "*"+sessionHashTag(sessionId)+"*").Val(); len(keys) != 0 {
+				t.Fatalf("keys of the deleted session = %d, want none", len(keys))
+			}
+
+			if err := client.ZScore(ctx, sessionsSetKey, sessionId).Err(); err == nil {
+				t.Fatal("the deleted session is in the sessions set")
+			}
+
+			if err := client.ZScore(ctx, deletedSessionsSetKey, sessionId).Err(); err != nil {
+				t.Fatalf("ZScore() of the deleted sessions error = %v, want the deleted session", err)
+			}
+
+			if err := commands.DeleteSession(ctx, sessionId); !errors.Is(err, api.ErrSessionNotFound) {
+				t.Fatalf("DeleteSession() of a deleted session error = %v, want %v", err, api.ErrSessionNotFound)
+			}
+		})
+	}
+}
+
+func TestDeleteSessionOffloaded(t *testing.T) {
+	ctx := context.Background()
+	commands, client := newTestRedisCommands(t)
+
+	sessionId, err := commands.CreateSession(ctx, api.DefaultCreateSessionOptions())
+
+	if err != nil {
+		t.Fatalf("CreateSession() error = %v", err)
+	}
+
+	offloadTestSession(t, commands, sessionId, OffloadOptions{})
+
+	if err := commands.ConfirmSessionOffload(ctx, sessionId, api.NewSessionLocation("host", "session"), api.OffloadSessionOptions{}, nil); err != nil {
+		t.Fatalf("ConfirmSessionOffload() error = %v", err)
+	}
+
+	if err := commands.DeleteSession(ctx, sessionId); err != nil {
+		t.Fatalf("DeleteSession() error = %v", err)
+	}
+
+	if err := client.ZScore(ctx, offloadedSessionsSetKey, sessionId).Err(); err == nil {
+		t.Fatal("the deleted session is in the offloaded sessions set")
+	}
+}
+
+func TestDeleteSessionErrors(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		session func(t *testing.T, commands *RedisCommands) string
+		want    error
+	}{
+		{
+			name:    "missing",
+			session: func(t *testing.T, commands *RedisCommands) string { return "missing" },
+			want:    api.ErrSessionNotFound,
+		},
+		{
+			name: "acquired",
+			session: func(t *testing.T, commands *RedisCommands) string {
+				sessionId, err := commands.CreateAndAcquireSession(ctx, api.DefaultCreateAndAcquireSessionOptions())
+
+				if err != nil {
+					t.Fatalf("CreateAndAcquireSession() error = %v", err)
+				}
+
+				return sessionId
+			},
+			want: ErrSessionIsAcquired,
+		},
+		{
+			name: "offloading",
+			session: func(t *testing.T, commands *RedisCommands) string {
+				sessionId, err := commands.CreateSession(ctx, api.DefaultCreateSessionOptions())
+
+				if err != nil {
+					t.Fatalf("CreateSession() error = %v", err)
+				}
+
+				offloadTestSession(t, commands, sessionId, OffloadOptions{})
+				return sessionId
+			},
+			want: api.ErrSessionIsOffloading,
+		},
+		{
+			name: "onloading",
+			session: func(t *testing.T, commands *RedisCommands) string {
+				sessionId, err := commands.onloadStart(ctx, api.SessionMetadata{CreatedIn: "origin"})
+
+				if err != nil {
+					t.Fatalf("onloadStart() error = %v", err)
+				}
+
+				return sessionId
+			},
+			want: ErrSessionIsOnloading,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			commands, client := newTestRedisCommands(t)
+			sessionId := test.session(t, commands)
+
+			if err := commands.DeleteSession(ctx, sessionId); !errors.Is(err, test.want) {
+				t.Fatalf("DeleteSession() error = %v, want %v", err, test.want)
+			}
+
+			// The session is left as it was.
+			if test.want != api.ErrSessionNotFound && client.HGet(ctx, sessionMetadataKey(sessionId), "state").Val() == "DELETING" {
+				t.Fatal("the session is DELETING after a failed deletion")
+			}
+		})
+	}
+}
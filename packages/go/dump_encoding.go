@@ -0,0 +1,191 @@
+package redis_commands
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// The maximum length of the key and of the payload of a record, that is the
+// maximum length of a Redis string.
+const maxDumpRecordFieldLength = 512 << 20
+
+// The maximum number of records and of bytes restored by a single call.
+const (
+	onloadDumpChunkRecords = 20
+	onloadDumpChunkBytes   = 1 << 20
+)
+
+// A key of the session data in the dump encoding.
+type dumpRecord struct {
+	// The key, without the prefix of the session key space.
+	key string
+	// The remaining time to live in milliseconds, 0 if the key does not
+	// expire. The time spent in transfer is not subtracted, so a key may live
+	// on the onloading node a little longer than on the origin node.
+	pttl int64
+	// The DUMP payload of the value.
+	payload string
+}
+
+// Appends the encoding of a record to the buffer, that is the length of the
+// key, the key, the time to live, the length of the payload and the payload.
+// Integers are encoded as varints.
+func appendDumpRecord(buffer []byte, record dumpRecord) []byte {
+	buffer = binary.AppendUvarint(buffer, uint64(len(record.key)))
+	buffer = append(buffer, record.key...)
+	buffer = binary.AppendVarint(buffer, record.pttl)
+	buffer = binary.AppendUvarint(buffer, uint64(len(record.payload)))
+	return append(buffer, record.payload...)
+}
+
+// Reads the next record of the stream. It returns io.EOF only if the stream
+// ends before the record.
+func readDumpRecord(reader *bufio.Reader) (dumpRecord, error) {
+	key, err := readDumpRecordField(reader)
+
+	if err != nil {
+		return dumpRecord{}, err
+	}
+
+	pttl, err := binary.ReadVarint(reader)
+
+	if err != nil {
+		return dumpRecord{}, truncatedDumpRecordError(err)
+	}
+
+	payload, err := readDumpRecordField(reader)
+
+	if err != nil {
+		return dumpRecord{}, truncatedDumpRecordError(err)
+	}
+
+	return dumpRecord{key: key, pttl: pttl, payload: payload}, nil
+}
+
+// Reads a length prefixed field of a record.
+func readDumpRecordField(reader *bufio.Reader) (string, error) {
+	length, err := binary.ReadUvarint(reader)
+
+	if err != nil {
+		return "", err
+	}
+
+	if length > maxDumpRecordFieldLength {
+		return "", fmt.Errorf("%w: field of %d bytes", ErrInvalidOffloadData, length)
+	}
+
+	// Read through a limited reader, so that a corrupted length does not
+	// allocate the whole field upfront, but only the bytes left in the chunk.
+	field, err := io.ReadAll(io.LimitReader(reader, int64(length)))
+
+	if err != nil {
+		return "", err
+	}
+
+	if uint64(len(field)) != length {
+		return "", truncatedDumpRecordError(io.ErrUnexpectedEOF)
+	}
+
+	return string(field), nil
+}
+
+// Returns the error of a record that has been read partially.
+func truncatedDumpRecordError(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w: truncated record", ErrInvalidOffloadData)
+	}
+
+	return err
+}
+
+// Reads a chunk of session data in the dump encoding of about chunkSize bytes
+// from the pending keys of the cursor, that is advanced past the keys that have
+// been dumped. It returns the records of the chunk and their number.
+func (c *RedisCommands) offloadDumpChunk(
+	ctx context.Context,
+	id string,
+	cursor *offloadCursor,
+	chunkSize int64,
+) ([]byte, int64, error) {
+	if len(cursor.pending) == 0 {
+		return nil, 0, nil
+	}
+
+	keys := cursor.pending[:min(len(cursor.pending), offloadChunkKeys)]
+	result, err := c.fcall(ctx, "offload_dump", sessionKeys(id, keys...), id, chunkSize).Slice()
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	cursor.pending = cursor.pending[result[0].(int64):]
+
+	var buffer []byte
+	records := result[1].([]interface{})
+	for i := 0; i+2 < len(records); i += 3 {
+		pttl, err := strconv.ParseInt(records[i+1].(string), 10, 64)
+
+		if err != nil {
+			return nil, 0, err
+		}
+
+		buffer = appendDumpRecord(buffer, dumpRecord{
+			key:     records[i].(string),
+			pttl:    pttl,
+			payload: records[i+2].(string),
+		})
+	}
+
+	return buffer, int64(len(records) / 3), nil
+}
+
+// Reads the records of a chunk of session data in the dump encoding and
+// restores them in the onloading session, in batches. It returns the number of
+// records restored.
+func (c *RedisCommands) onloadDumpChunk(
+	ctx context.Context,
+	sessionId string,
+	chunk []byte,
+) (int64, error) {
+	reader := bufio.NewReader(bytes.NewReader(chunk))
+	args := []interface{}{sessionId}
+	keys := sessionKeys(sessionId)
+	declared := len(keys)
+	size := 0
+	var restored int64
+
+	for {
+		record, err := readDumpRecord(reader)
+
+		if err != nil && err != io.EOF {
+			return restored, err
+		}
+
+		if err == nil {
+			args = append(args, record.key, strconv.FormatInt(record.pttl, 10), record.payload)
+			keys = append(keys, sessionDataKey(sessionId, record.key))
+			size += len(record.key) + len(record.payload)
+		}
+
+		// Restore the batch once it is full or the chunk is over.
+		full := len(args)-1 >= 3*onloadDumpChunkRecords || size >= onloadDumpChunkBytes
+		if (full || err == io.EOF) && len(args) > 1 {
+			if err := c.fcall(ctx, "onload_restore", keys, args...).Err(); err != nil {
+				return restored, err
+			}
+
+			restored += int64((len(args) - 1) / 3)
+			args, keys, size = args[:1], keys[:declared], 0
+		}
+
+		if err == io.EOF {
+			return restored, nil
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package redis_commands
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestDumpRecordRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		record dumpRecord
+	}{
+		{"no time to live", dumpRecord{key: "key", payload: "\x00\x03abc\x0b\x00"}},
+		{"time to live", dumpRecord{key: "key", pttl: 60000, payload: "payload"}},
+		{"empty key and payload", dumpRecord{}},
+		{"binary key", dumpRecord{key: "\x00\xff:{}", payload: "\xff"}},
+		{"long payload", dumpRecord{key: "k", payload: strings.Repeat("p", 1<<16)}},
+	}
+
+	// The records are read back one after the other from the same stream.
+	var stream []byte
+	for _, test := range tests {
+		stream = appendDumpRecord(stream, test.record)
+	}
+
+	reader := newBytesReader(stream)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			record, err := readDumpRecord(reader)
+
+			if err != nil {
+				t.Fatalf("readDumpRecord() error = %v", err)
+			}
+
+			if record != test.record {
+				t.Fatalf("readDumpRecord() = %+v, want %+v", record, test.record)
+			}
+		})
+	}
+
+	if _, err := readDumpRecord(reader); err != io.EOF {
+		t.Fatalf("readDumpRecord() at the end error = %v, want io.EOF", err)
+	}
+}
+
+func TestReadDumpRecordErrors(t *testing.T) {
+	record := appendDumpRecord(nil, dumpRecord{key: "key", pttl: 60000, payload: "payload"})
+	// The length of the key, the key and the time to live.
+	payloadOffset := 1 + len("key") + binary.PutVarint(make([]byte, binary.MaxVarintLen64), 60000)
+
+	tests := []struct {
+		name  string
+		input []byte
+		want  error
+	}{
+		{"empty", nil, io.EOF},
+		{"truncated key", record[:2], ErrInvalidOffloadData},
+		{"missing time to live", record[:1+len("key")], ErrInvalidOffloadData},
+		{"truncated time to live", record[:1+len("key")+1], ErrInvalidOffloadData},
+		{"missing payload length", record[:payloadOffset], ErrInvalidOffloadData},
+		{"truncated payload", record[:len(record)-1], ErrInvalidOffloadData},
+		{"oversized key", binary.AppendUvarint(nil, maxDumpRecordFieldLength+1), ErrInvalidOffloadData},
+		{"oversized payload", binary.AppendUvarint(record[:payloadOffset], maxDumpRecordFieldLength+1), ErrInvalidOffloadData},
+		{"huge length", append(binary.AppendUvarint(nil, maxDumpRecordFieldLength), "short"...), ErrInvalidOffloadData},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := readDumpRecord(newBytesReader(test.input))
+
+			if !errors.Is(err, test.want) {
+				t.Fatalf("readDumpRecord() error = %v, want %v", err, test.want)
+			}
+		})
+	}
+}
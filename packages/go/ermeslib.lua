@@ -0,0 +1,2598 @@
+#!lua name=ermeslib
+
+-- Version of the library, compared by EnsureLibrary with the version of the
+-- installed library to upgrade it. It must be increased on every change.
+local library_version = 22
+
+--[[
+The states of a single session are the following:
+    - ONLOADING     : The session is being onloaded from another node.
+    - ACTIVE        : The session is active.
+    - OFFLOADING    : The session is being offloaded to another node.
+    - OFFLOADED     : The session has been offloaded to another node, it will
+                      remain so for a while to allow the node to notify the
+                      offload to the client on the following request.
+    - DELETING      : The session is being deleted.
+For internal functioning, in each state we track
+    - non_offloadable_uses  : The number of usages that do not allow the session to be offloaded.
+    - OffloadableUses       : The number of usages that allow the session to be offloaded.
+
+
+The full state machine is described here:
+    ONLOADING: The session is being onloaded from another node.
+        - State:
+            - non_offloadable_uses  : 0,
+            - OffloadableUses       : 0,
+        - Transitions:
+            (_, _) onload_data   -> ONLOADING (_, _)}.
+            (_, _) onload_finish -> ACTIVE    (_, _)}.
+            (_, _) onload_cancel -> DELETING  (_, _)}.
+
+    ACTIVE: The session is active
+        - State
+            - non_offloadable_uses  : 0-N,
+            - OffloadableUses       : 0-N,
+        - Transitions:
+            (0-N, _  ) acquire              -> ACTIVE     ($++, _  )}.
+            (1-N, _  ) release              -> ACTIVE     ($--, _  )}.
+            (_  , 0-N) acquire-offloadable  -> ACTIVE     (_  , $++)}.
+            (_  , 1-N) release-offloadable  -> ACTIVE     (_  , $--)}.
+            (0  , 0-N) offload              -> OFFLOADING (_  , _  )}.
+            (0  , 0  ) delete               -> DELETING   (_  , _  )}.
+            (0  , 0  ) collect              -> DELETING   (_  , _  )}. if expired
+            (1-N, 1-N) collect              -> DELETING   (_  , _  )}. if expired more than ttl ago
+
+    OFFLOADING: The session is being offloaded to another node.
+        - State
+            - non_offloadable_uses  : 0,
+            - OffloadableUses       : 0-N
+        - Transitions
+            (_  , 0-N) acquire-offloadable  -> ACTIVE    (_  , $++)}.
+            (_  , 1-N) release-offloadable  -> ACTIVE    (_  , $--)}.
+            (_  , _  ) offload-finish       -> OFFLOADED (_  , _  )}.
+            (_  , _  ) offload-cancel       -> ACTIVE    (_  , _  )}.
+        The expiration is left unchanged, the session is only excluded from the
+        collection, so a cancel returns it to its pre-offload state.
+
+    OFFLOADED: The session has been offloaded to another node.
+        - State
+            - non_offloadable_uses  : 0,
+            - OffloadableUses       : 0-N
+        - Transitions
+            (_  , 1-N) release-offloadable -> ACTIVE    (_  , $--)}.
+            (_  , 0  ) collect             -> DELETING  (_  , _  )}. if expired
+            (_  , 1-N) collect             -> DELETING  (_  , _  )}. if expired more than ttl ago
+
+    DELETING: The session is being deleted, chunk by chunk.
+        - Transitions
+            (_  , _  ) delete-chunk        -> DELETING  (_  , _  )}.
+            (_  , _  ) delete-chunk final  -> (removed)}.
+            (_  , _  ) collect             -> DELETING  (_  , _  )}. resumes an interrupted deletion
+
+ONLOADING and OFFLOADING sessions are never collected, as another node is
+reading or writing them: an onload that is abandoned is canceled, and the
+session becomes DELETING.
+--]]
+
+
+-- Error codes. Each error reply starts with one of these codes followed by a
+-- message, clients rely on the code only, the message is for humans.
+local error_codes = {
+    -- The session does not exist (or is not visible, e.g. while onloading).
+    NOT_FOUND = 'ERMES_NOT_FOUND',
+    -- The session is expired.
+    EXPIRED = 'ERMES_EXPIRED',
+    -- The session is offloading.
+    OFFLOADING = 'ERMES_OFFLOADING',
+    -- The session is onloading.
+    ONLOADING = 'ERMES_ONLOADING',
+    -- The session is acquired, so it cannot be deleted.
+    ACQUIRED = 'ERMES_ACQUIRED',
+    -- The session is acquired in a way that prevents its offload.
+    OFFLOAD_ACQUIRED = 'ERMES_OFFLOAD_ACQUIRED',
+    -- There is no acquisition of the session to release.
+    NO_ACQUISITION = 'ERMES_NO_ACQUISITION',
+    -- The session is not in the state required by the operation.
+    INVALID_STATE = 'ERMES_INVALID_STATE',
+    -- An argument is not valid.
+    INVALID_ARGUMENT = 'ERMES_INVALID_ARGUMENT',
+    -- The session is not offloaded.
+    NOT_OFFLOADED = 'ERMES_NOT_OFFLOADED',
+    -- A cursor is not valid.
+    INVALID_CURSOR = 'ERMES_INVALID_CURSOR',
+    -- No node satisfies the request.
+    NODE_NOT_FOUND = 'ERMES_NODE_NOT_FOUND',
+    -- The id of the current node is not set.
+    NO_CURRENT_NODE = 'ERMES_NO_CURRENT_NODE',
+}
+
+-- Return an error reply with the given code and message.
+local function error_reply(code, message)
+    return redis.error_reply(code .. ' ' .. message)
+end
+
+-- Raise an error with the given code and message. Unlike error_reply, it can
+-- be used in nested functions.
+local function raise(code, message)
+    error(error_reply(code, message))
+end
+
+-- Return the error reply for a session that is not in the expected state.
+local function state_error_reply(session_id, state, expected_state)
+    if not state then
+        return error_reply(error_codes.NOT_FOUND, 'session ' .. session_id .. ' does not exist')
+    end
+
+    return error_reply(error_codes.INVALID_STATE,
+        'session ' .. session_id .. ' is ' .. state .. ', expected ' .. expected_state)
+end
+
+--[[
+The keys of a session (its data, its metadata and the index of its data keys)
+share the hash tag of the session id, so that Redis Cluster maps them to the
+same slot, while the keys of the node (the sets that index the sessions of the
+node, the configuration and the infrastructure) share the hash tag of the node
+keyspace. A function touches either the keys of a single session or the keys of
+the node, never both, so it is never cross-slot: the functions on a session
+return its state, that the caller syncs in the index of the node with
+sync_session_index. The functions receive the ids as args and all the keys they
+touch as keys, the keys of the session data included, that are returned by
+scan_session_data.
+--]]
+local node_keyspace_prefix = '{ermes}:'
+
+-- The hash of the infrastructure, that maps each node to its json.
+local infrastructure_nodes = node_keyspace_prefix .. 'i:nodes'
+-- The hash of the infrastructure, that maps each node to its parent.
+local infrastructure_parents = node_keyspace_prefix .. 'i:parents'
+-- The hash of the infrastructure, that maps each node to the json of the last
+-- resources usage it reported. The json maps each resource to its usage, plus
+-- the reserved fields:
+--     'ermes:sessions' : The number of sessions of the node.
+--     'ermes:version'  : The version of the usage, the time in milliseconds at
+--                        which the node computed it.
+local infrastructure_usage = node_keyspace_prefix .. 'i:usage'
+-- Generate a key in the config keyspace.
+local function config_key(key)
+    return node_keyspace_prefix .. 'c:' .. key
+end
+-- Return the hash tag of the keys of a session.
+local function session_hash_tag(session_id)
+    return '{' .. session_id .. '}'
+end
+-- Generate a key in the session keyspace.
+local function session_data_key(session_id, key)
+    return 's:' .. session_hash_tag(session_id) .. ':' .. key
+end
+-- Generate a key in the session metadata keyspace.
+local function session_metadata_key(session_id)
+    --[[
+    The session metadata is stored in a hash with the following fields (Note that some properties are like score and
+    expiration are stored also in the index of the node and are kept in sync):
+        'state',
+        'version',
+        'non_offloadable_uses',
+        'offloadable_uses',
+        'client_lat',
+        'client_long',
+        'offloaded_to_host',
+        'offloaded_to_session',
+        'redirected',
+        'previous_node',
+        'previous_session',
+        'indexed',
+        'created_in',
+        'created_at',
+        'created_at',
+        'expires_at',
+        'updated_at',
+    --]]
+    return 'm:' .. session_hash_tag(session_id) .. ':metadata'
+end
+-- Generate a key in the session metadata keyspace for the index of the keys of
+-- the session data.
+local function session_keys_index_key(session_id)
+    -- The index is a set of the keys of the session data, without the prefix of
+    -- the session keyspace. Only the sessions with the 'indexed' metadata field
+    -- set have the index, that is fixed when the session is created or onloaded,
+    -- the data of the other sessions is scanned.
+    return 'm:' .. session_hash_tag(session_id) .. ':keys'
+end
+-- Extract the key from the session data key.
+local function extract_key_from_session_data_key(session_id, key)
+    return string.sub(key, #session_data_key(session_id, '') + 1)
+end
+
+-- Hash that maps each session of the node to the json of its entry, that is
+-- the state of the session as last synced by sync_session_index.
+local sessions_index = config_key('sessions_index')
+-- Ordered set by expiration (or +inf if no expiration is set) of the sessions.
+-- Sessions that are being used have as score the negative of the expiration time.
+-- (or -inf if no expiration is set), sessions that are onloading or offloading
+-- have score -inf and sessions that are being deleted have score 0.
+local sessions_set = config_key('sessions_set')
+-- Ordered set by score of the sessions that can be offloaded.
+local offloadable_sessions_set = config_key('offloadable_sessions_set')
+-- Ordered set by score of the sessions that are offloaded.
+local offloaded_sessions_set = config_key('offloaded_sessions_set')
+-- Ordered set by deletion time of the sessions that have been deleted, whose
+-- entry is kept for a while to discard the stale updates of the index.
+local deleted_sessions_set = config_key('deleted_sessions_set')
+-- Hash that maps each session to the json of its resources usage. It is kept
+-- with the index, on the slot of the node, so that the resources usage of the
+-- node is updated in the same call as the one of the session. As a
+-- consequence, the usage of a session that is offloaded or deleted is removed
+-- from the one of the node by the sync of its entry, not by the function that
+-- offloads or deletes it: the usage of the node is eventually consistent with
+-- the sessions it hosts.
+local sessions_resources = config_key('sessions_resources')
+-- Geo set of the nodes.
+local nodes_geoset = config_key('nodes_geoset')
+-- Hash of the resources usage of the sessions of the current node, kept in
+-- sync with the resources usage of each session.
+local resources_usage = config_key('resources_usage')
+-- Hash of the version of the resources usage of each node last sent to the
+-- parent node.
+local resources_usage_sent = config_key('resources_usage_sent')
+-- Hash of the version of the resources usage of each node included in the
+-- updates sent to the parent node that have not been delivered yet.
+local resources_usage_pending = config_key('resources_usage_pending')
+-- Time in milliseconds of the last full update sent to the parent node.
+local resources_usage_full_update_at = config_key('resources_usage_full_update_at')
+-- Interval in milliseconds between two full updates sent to the parent node,
+-- that recover the updates that have been lost.
+local resources_usage_full_update_interval = 60000
+-- Reserved fields of the resources usage of a node.
+local usage_sessions_field = 'ermes:sessions'
+local usage_version_field = 'ermes:version'
+-- Key mapped to the id of the current node. It is stored in the keyspace so
+-- that it survives the reloads of the library, the restarts and the failovers.
+local current_node_key = config_key('current_node')
+-- Time in seconds after which the entries of the deleted sessions are removed
+-- from the index. It must exceed the time between a change of a session and its
+-- sync, so that a stale sync never recreates the entry of a deleted session.
+local deleted_sessions_retention = 3600
+
+-- Assert that the id is not empty, otherwise raise an error.
+local function assert_valid_id(id)
+    if id == '' then
+        raise(error_codes.INVALID_ARGUMENT, 'id cannot be empty')
+    end
+
+    -- session_id must not contain ":"
+    if string.find(id, ':') then
+        raise(error_codes.INVALID_ARGUMENT, 'id cannot contain ":"')
+    end
+
+    -- the id is the hash tag of the keys of a session, so it cannot contain
+    -- braces.
+    if string.find(id, '[{}]') then
+        raise(error_codes.INVALID_ARGUMENT, 'id cannot contain "{" or "}"')
+    end
+end
+
+-- Assert that the geo coordinates are valid, otherwise raise an error.
+local function assert_valid_geo_coordinates(lat, long)
+    local lat_number, long_number = tonumber(lat), tonumber(long)
+    -- Check if lat and long are valid.
+    if lat_number == nil or long_number == nil or
+        lat_number < -90 or lat_number > 90 or long_number < -180 or long_number > 180 then
+        raise(error_codes.INVALID_ARGUMENT,
+            'geo coordinates are not valid, got ' .. tostring(lat) .. ' ' .. tostring(long))
+    end
+end
+
+-- Assert that the string is nil or a valid Unix timestamp, otherwise raise an
+-- error.
+local function assert_valid_timestamp_string_greater_than(string_timestamp, any)
+    if tonumber(string_timestamp) == nil or tonumber(string_timestamp) < (tonumber(any) or 0) then
+        raise(error_codes.INVALID_ARGUMENT, 'unix timestamp is not valid, must be greater than ' ..
+            (tonumber(any) or 0) .. ' got ' .. string_timestamp)
+    end
+end
+
+-- Return the keys of a session, that are the keys declared by the functions on
+-- a session, followed by the keys of its data that they touch.
+local function session_keys(session_id)
+    return {
+        session_metadata_key(session_id),
+        session_keys_index_key(session_id),
+    }
+end
+
+-- The keys of the index of the sessions of the node.
+local sessions_index_keys = {
+    sessions_index,
+    sessions_set,
+    offloadable_sessions_set,
+    offloaded_sessions_set,
+    deleted_sessions_set,
+    sessions_resources,
+    resources_usage,
+}
+
+-- The keys that hold the id and the resources usage of the current node.
+local node_usage_keys = { current_node_key, sessions_set, offloaded_sessions_set, resources_usage }
+
+-- The keys of the infrastructure.
+local infrastructure_keys = { nodes_geoset, infrastructure_nodes, infrastructure_parents, infrastructure_usage }
+
+-- Assert that the given lists of keys have been declared, otherwise raise an
+-- error.
+local function assert_declared_keys(keys, ...)
+    local declared = {}
+    for _, key in ipairs(keys) do
+        declared[key] = true
+    end
+
+    for _, expected in ipairs({ ... }) do
+        for _, key in ipairs(expected) do
+            if not declared[key] then
+                raise(error_codes.INVALID_ARGUMENT, 'key ' .. key .. ' must be declared')
+            end
+        end
+    end
+end
+
+-- Return the keys of the session data among the declared keys, that are the
+-- ones with the prefix of the session keyspace.
+local function declared_session_data_keys(keys, session_id)
+    local prefix = session_data_key(session_id, '')
+    local data_keys = {}
+    for _, key in ipairs(keys) do
+        if string.sub(key, 1, #prefix) == prefix then
+            table.insert(data_keys, key)
+        end
+    end
+
+    return data_keys
+end
+
+-- Return the id of the current node, nil if it is not set.
+local function current_node_id()
+    return redis.call('GET', current_node_key) or nil
+end
+
+-- Return the id of the current node, raise an error if it is not set.
+local function assert_current_node_id()
+    local node_id = current_node_id()
+
+    if not node_id then
+        raise(error_codes.NO_CURRENT_NODE, 'the id of the current node is not set')
+    end
+
+    return node_id
+end
+
+-- Return the current time in microseconds.
+local function time_us()
+    local time = redis.call('TIME')
+    return tonumber(time[1]) * 1000000 + tonumber(time[2])
+end
+
+-- Increase the version of the metadata of a session, that orders the syncs of
+-- its entry in the index of the node. It is the current time in microseconds,
+-- unless the previous version is not older.
+local function touch_session(metadata_key)
+    local version = math.max(time_us(), (tonumber(redis.call('HGET', metadata_key, 'version')) or 0) + 1)
+    redis.call('HSET', metadata_key, 'version', string.format('%d', version))
+end
+
+-- Function that set the id of the current node.
+redis.register_function('set_current_node_key', function(keys, args)
+    -- Args.
+    local node_id = args[1]
+
+    -- Check if the node id is valid.
+    assert_valid_id(node_id)
+    -- Check that the key of the current node is declared.
+    assert_declared_keys(keys, { current_node_key })
+
+    -- Set the id of the current node.
+    redis.call('SET', current_node_key, node_id)
+    -- Return OK.
+    return 'OK'
+end)
+
+-- Function that return the id of the current node.
+redis.register_function('get_current_node_key', function(keys, args)
+    -- Check that the key of the current node is declared.
+    assert_declared_keys(keys, { current_node_key })
+
+    return assert_current_node_id()
+end)
+
+-- Convert a flat list of key and value pairs (as returned by HGETALL) to a
+-- table that maps each key to its value, that is encoded as a json object.
+local function flat_to_map(flat)
+    local map = {}
+    for i = 1, #flat, 2 do
+        map[flat[i]] = flat[i + 1]
+    end
+    return map
+end
+
+-- Return the given table if it maps keys to values, or convert it if it is a
+-- flat list of key and value pairs.
+local function map_or_flat_to_map(values)
+    if values[1] ~= nil then
+        return flat_to_map(values)
+    end
+    return values
+end
+
+-- The maximum number of values added to a key by a single command, that bounds
+-- the number of arguments unpacked at once.
+local add_batch_size = 100
+
+-- Call a command that adds the values to a key, in batches of add_batch_size
+-- values. The batch size is even, so pairs of values are never split.
+local function add_in_batches(command, key, values)
+    for i = 1, #values, add_batch_size do
+        redis.call(command, key, unpack(values, i, math.min(i + add_batch_size - 1, #values)))
+    end
+end
+
+-- Add the given delta to the resources usage of the current node. Resources
+-- whose usage drops to zero are removed.
+local function increment_resources_usage(resource, delta)
+    if delta == 0 then
+        return
+    end
+
+    local usage = tonumber(redis.call('HINCRBYFLOAT', resources_usage, resource, delta))
+
+    -- Remove the rounding errors accumulated by the increments.
+    if math.abs(usage) < 1e-9 then
+        redis.call('HDEL', resources_usage, resource)
+    end
+end
+
+-- Remove the resources usage of a session from the resources usage of the
+-- current node, then delete it.
+local function remove_session_resources_usage(session_id)
+    local usage = redis.call('HGET', sessions_resources, session_id)
+
+    if not usage then
+        return
+    end
+
+    for resource, value in pairs(cjson.decode(usage)) do
+        increment_resources_usage(resource, -tonumber(value))
+    end
+
+    redis.call('HDEL', sessions_resources, session_id)
+end
+
+-- Return the entry of a session in the index of the node, nil if the session
+-- has not been synced or has been deleted.
+local function session_index_entry(session_id)
+    local entry = redis.call('HGET', sessions_index, session_id)
+
+    if not entry then
+        return nil
+    end
+
+    entry = cjson.decode(entry)
+    if entry['state'] == 'DELETED' then
+        return nil
+    end
+
+    return entry
+end
+
+-- The fields of the metadata of a session that are synced in its entry in the
+-- index of the node.
+local session_index_entry_fields = {
+    'state', 'version', 'non_offloadable_uses', 'offloadable_uses',
+    'client_lat', 'client_long', 'created_in', 'created_at', 'updated_at', 'expires_at',
+}
+
+-- Function that return the json of the entry of a session in the index of the
+-- node, that is the state of the session to sync with sync_session_index. It
+-- returns an empty string if the session does not exist.
+redis.register_function('get_session_index_entry', function(keys, args)
+    -- Args.
+    local session_id = args[1]
+    -- Check that the keys of the session are declared.
+    assert_declared_keys(keys, session_keys(session_id))
+    -- Get the fields of the entry.
+    local result = redis.call('HMGET', session_metadata_key(session_id), unpack(session_index_entry_fields))
+
+    -- If session does not exist, return an empty string.
+    if not result[1] then
+        return ""
+    end
+
+    -- The fields are kept as strings, so that the version is never rounded.
+    local entry = {}
+    for i, field in ipairs(session_index_entry_fields) do
+        entry[field] = result[i] or ""
+    end
+
+    return cjson.encode(entry)
+end)
+
+-- Function that sync the entry of a session in the index of the node, that are
+-- the sets of the sessions and the resources usage of the node. Args are the
+-- session id and the json of the entry, as returned by get_session_index_entry
+-- or by the deletion of the session. Entries that are not newer than the synced
+-- one are ignored, so that syncs can be applied more than once and in any
+-- order. A deleted session without version supersedes any entry. It returns 1
+-- if the entry has been synced, 0 otherwise.
+redis.register_function('sync_session_index', function(keys, args)
+    -- Args.
+    local session_id = args[1]
+    local ok, entry = pcall(cjson.decode, args[2] or "")
+    -- Check that the keys of the index are declared.
+    assert_declared_keys(keys, sessions_index_keys)
+
+    -- Check if the entry is valid.
+    if not ok or type(entry) ~= 'table' or type(entry['state']) ~= 'string' then
+        return error_reply(error_codes.INVALID_ARGUMENT, 'entry of session ' .. session_id .. ' is not valid')
+    end
+
+    -- Discard the entries that are not newer than the synced one.
+    local synced = redis.call('HGET', sessions_index, session_id)
+    local synced_version = synced and tonumber(cjson.decode(synced)['version']) or 0
+    local version = tonumber(entry['version'])
+    if not version and entry['state'] == 'DELETED' then
+        version = synced_version + 1
+        entry['version'] = string.format('%d', version)
+    elseif not version then
+        return error_reply(error_codes.INVALID_ARGUMENT, 'entry of session ' .. session_id .. ' has no version')
+    end
+    if version <= synced_version then
+        return 0
+    end
+
+    local state = entry['state']
+    redis.call('HSET', sessions_index, session_id, cjson.encode(entry))
+
+    -- The resources of the sessions that are not hosted anymore are released.
+    if state == 'OFFLOADED' or state == 'DELETING' or state == 'DELETED' then
+        remove_session_resources_usage(session_id)
+    end
+
+    -- The entry of a deleted session is kept only to discard the stale syncs.
+    if state == 'DELETED' then
+        redis.call('ZREM', sessions_set, session_id)
+        redis.call('ZREM', offloadable_sessions_set, session_id)
+        redis.call('ZREM', offloaded_sessions_set, session_id)
+        redis.call('ZADD', deleted_sessions_set, redis.call('TIME')[1], session_id)
+        return 1
+    end
+
+    redis.call('ZREM', deleted_sessions_set, session_id)
+
+    local expires_at = entry['expires_at'] or ""
+    local uses = (tonumber(entry['non_offloadable_uses']) or 0) + (tonumber(entry['offloadable_uses']) or 0)
+
+    -- Add it to the sessions_set.
+    if state == 'DELETING' then
+        redis.call('ZADD', sessions_set, 0, session_id)
+    elseif state == 'ONLOADING' or state == 'OFFLOADING' then
+        redis.call('ZADD', sessions_set, '-inf', session_id)
+    elseif uses > 0 then
+        redis.call('ZADD', sessions_set, '-' .. (expires_at ~= "" and expires_at or 'inf'), session_id)
+    else
+        redis.call('ZADD', sessions_set, expires_at ~= "" and expires_at or '+inf', session_id)
+    end
+
+    -- Add it to the offloadable_sessions_set if it is active and not acquired
+    -- in a non offloadable way.
+    if state == 'ACTIVE' and tonumber(entry['non_offloadable_uses']) == 0 then
+        redis.call('ZADD', offloadable_sessions_set, entry['updated_at'], session_id)
+    else
+        redis.call('ZREM', offloadable_sessions_set, session_id)
+    end
+
+    -- Add it to the offloaded_sessions_set if it is offloaded.
+    if state == 'OFFLOADED' then
+        redis.call('ZADD', offloaded_sessions_set, expires_at ~= "" and expires_at or '+inf', session_id)
+    else
+        redis.call('ZREM', offloaded_sessions_set, session_id)
+    end
+
+    -- Return 1.
+    return 1
+end)
+
+-- Scan about "count" keys of the session data starting from the given cursor.
+-- The keys of an indexed session are read from its index, so that the cost
+-- depends on the size of the session, otherwise the whole keyspace is scanned.
+-- Returns the next cursor ('0' when the scan is completed) and the keys, that
+-- may include indexed keys that expired in the meanwhile.
+local function scan_session_data_keys(session_id, cursor, count)
+    local index_key = session_keys_index_key(session_id)
+
+    if redis.call('HGET', session_metadata_key(session_id), 'indexed') ~= '1' then
+        local result = redis.call('SCAN', cursor, 'MATCH', session_data_key(session_id, '*'), 'COUNT', count)
+        return result[1], result[2]
+    end
+
+    local result = redis.call('SSCAN', index_key, cursor, 'COUNT', count)
+    local data_keys = {}
+    for i, key in ipairs(result[2]) do
+        data_keys[i] = session_data_key(session_id, key)
+    end
+
+    return result[1], data_keys
+end
+
+-- Function that scan about "count" keys of the session data, starting from the
+-- given SCAN cursor (empty or '0' to start). It performs a single scan, so its
+-- cost is bounded even if the whole keyspace is scanned. It returns the next
+-- cursor, that is '0' once the scan is completed, and the keys, that the
+-- functions that read or delete the session data must declare.
+redis.register_function('scan_session_data', function(keys, args)
+    -- Args.
+    local session_id = args[1]
+    local cursor = args[2] ~= "" and args[2] or '0'
+    local count = tonumber(args[3])
+    -- Check that the keys of the session are declared.
+    assert_declared_keys(keys, session_keys(session_id))
+
+    -- Check the cursor.
+    if not string.match(cursor, "^%d+$") then
+        return error_reply(error_codes.INVALID_CURSOR, 'cursor must be a SCAN cursor, got ' .. cursor)
+    end
+
+    -- Check if the count is valid.
+    if count == nil or count < 1 then
+        return error_reply(error_codes.INVALID_ARGUMENT, 'count must be a positive number, got ' .. tostring(args[3]))
+    end
+
+    -- If session does not exist, return an error.
+    if redis.call('EXISTS', session_metadata_key(session_id)) == 0 then
+        return error_reply(error_codes.NOT_FOUND, 'session ' .. session_id .. ' does not exist')
+    end
+
+    -- Return the next cursor and the keys.
+    local next_cursor, data_keys = scan_session_data_keys(session_id, cursor, count)
+    return { next_cursor, data_keys }
+end)
+
+-- Unlink the declared keys of the session data of a session that is being
+-- deleted. If final is true, that is the keys are the last ones of the scan of
+-- the session data, the session metadata is deleted too. Returns the number of
+-- unlinked keys and, once the session has been completely deleted, the json of
+-- its entry in the index of the node, empty otherwise.
+local function unlink_session_chunk(keys, session_id, final)
+    -- Metadata.
+    local metadata_key = session_metadata_key(session_id)
+    -- The keys of the session data to unlink.
+    local data_keys = declared_session_data_keys(keys, session_id)
+
+    -- Unlink the keys, if any (UNLINK fails without arguments).
+    for i = 1, #data_keys, add_batch_size do
+        local batch = { unpack(data_keys, i, math.min(i + add_batch_size - 1, #data_keys)) }
+        redis.call('UNLINK', unpack(batch))
+        for j, key in ipairs(batch) do
+            batch[j] = extract_key_from_session_data_key(session_id, key)
+        end
+        redis.call('SREM', session_keys_index_key(session_id), unpack(batch))
+    end
+
+    -- If there are no more keys to delete, delete the session metadata.
+    if not final then
+        return { #data_keys, "" }
+    end
+
+    -- The deleted session supersedes any entry of the session.
+    local version = (tonumber(redis.call('HGET', metadata_key, 'version')) or 0) + 1
+    -- Delete the session metadata.
+    redis.call('DEL', metadata_key)
+    -- Delete the index of the session data keys.
+    redis.call('DEL', session_keys_index_key(session_id))
+
+    -- Return the number of unlinked keys and the entry.
+    return { #data_keys, cjson.encode({ state = 'DELETED', version = string.format('%d', version) }) }
+end
+
+-- Function that create a session and acquire it. The session is created in
+-- the given node, that is the current one. If the indexed flag is '1' the keys
+-- of the session data are indexed, see session_data_command. If a session with
+-- the same id already exists, return 0, otherwise return 1. The result is not a
+-- boolean, since false is replied as nil.
+redis.register_function('create_session', function(keys, args)
+    -- Args.
+    local session_id = args[1]
+    local client_lat = args[2]
+    local client_long = args[3]
+    local expires_at = args[4]
+    local acquire = args[5] -- "offloadable", "non-offloadable", ""
+    local created_in = args[6]
+    local indexed = args[7] == '1'
+    -- Check that the keys of the session are declared.
+    assert_declared_keys(keys, session_keys(session_id))
+    -- Metadata.
+    local metadata_key = session_metadata_key(session_id)
+    -- Get the current time.
+    local time = redis.call('TIME')[1]
+
+    -- Check if the session id is valid.
+    assert_valid_id(session_id)
+    -- Check if the node id is valid.
+    assert_valid_id(created_in or "")
+    if client_lat ~= "" or client_long ~= "" then
+        -- Check if the client coordinates are valid.
+        assert_valid_geo_coordinates(client_lat, client_long)
+    end
+    if expires_at ~= "" then
+        -- Check if the expires_at is valid.
+        assert_valid_timestamp_string_greater_than(expires_at, time)
+    end
+    -- Check if the acquire mode is valid.
+    if acquire ~= "" and acquire ~= 'offloadable' and acquire ~= 'non-offloadable' then
+        raise(error_codes.INVALID_ARGUMENT,
+            'acquire must be "offloadable", "non-offloadable" or empty, got ' .. acquire)
+    end
+
+    -- If session already exists, return 0.
+    if redis.call('EXISTS', metadata_key) == 1 then
+        return 0
+    end
+
+    -- Set the session metadata attributes, acquiring the session in the same
+    -- call so that it is never visible as not acquired.
+    redis.call('HMSET', metadata_key,
+        'state', 'ACTIVE',
+        'non_offloadable_uses', acquire == 'non-offloadable' and '1' or '0',
+        'offloadable_uses', acquire == 'offloadable' and '1' or '0',
+        'client_lat', client_lat,
+        'client_long', client_long,
+        'created_in', created_in,
+        'created_at', tostring(time),
+        'updated_at', tostring(time),
+        'expires_at', expires_at)
+    if indexed then
+        redis.call('HSET', metadata_key, 'indexed', '1')
+    end
+    touch_session(metadata_key)
+
+    -- Return 1.
+    return 1
+end)
+
+-- Function that create a session and set it for onload. If the indexed flag is
+-- '1' the onloaded keys are added to the index of the session, as the keys
+-- written afterwards. If a session with the same id already exists, return 0,
+-- otherwise return 1.
+redis.register_function('onload_start', function(keys, args)
+    -- Args.
+    local session_id = args[1]
+    local client_lat = args[2]
+    local client_long = args[3]
+    local created_in = args[4]
+    local created_at = args[5]
+    local updated_at = args[6]
+    local expires_at = args[7]
+    local indexed = args[8] == '1'
+    -- Check that the keys of the session are declared.
+    assert_declared_keys(keys, session_keys(session_id))
+    -- Metadata.
+    local metadata_key = session_metadata_key(session_id)
+
+    -- Check if the session id is valid.
+    assert_valid_id(session_id)
+    -- Check if the client coordinates are valid.
+    if client_lat ~= "" or client_long ~= "" then
+        -- Check if the client coordinates are valid.
+        assert_valid_geo_coordinates(client_lat, client_long)
+    end
+    -- Check if the updated_at is valid.
+    assert_valid_timestamp_string_greater_than(created_at, 0)
+    -- Check if the updated_at is valid.
+    assert_valid_timestamp_string_greater_than(updated_at, created_at)
+    if expires_at ~= "" then
+        -- Check if the expires_at is valid.
+        assert_valid_timestamp_string_greater_than(expires_at, created_at)
+        assert_valid_timestamp_string_greater_than(expires_at, redis.call('TIME')[1])
+    end
+
+    -- If session already exists, return 0.
+    if redis.call('EXISTS', metadata_key) == 1 then
+        return 0
+    end
+
+    -- Set the session metadata attributes.
+    redis.call('HMSET', metadata_key,
+        'state', 'ONLOADING',
+        'non_offloadable_uses', 0,
+        'offloadable_uses', 0,
+        'client_lat', client_lat,
+        'client_long', client_long,
+        'created_in', created_in,
+        'created_at', created_at,
+        'updated_at', updated_at,
+        'expires_at', expires_at)
+    if indexed then
+        redis.call('HSET', metadata_key, 'indexed', '1')
+    end
+    touch_session(metadata_key)
+
+    -- Return 1.
+    return 1
+end)
+
+-- Return a function that maps a key of the session data to its key in the
+-- session keyspace, raising an error if it has not been declared.
+local function declared_session_data_key_mapper(keys, session_id)
+    local declared = {}
+    for _, key in ipairs(declared_session_data_keys(keys, session_id)) do
+        declared[key] = true
+    end
+
+    return function(key)
+        local data_key = session_data_key(session_id, key)
+        if not declared[data_key] then
+            raise(error_codes.INVALID_ARGUMENT, 'key ' .. data_key .. ' must be declared')
+        end
+        return data_key
+    end
+end
+
+-- Function that set the session data after onload. This function is separeted
+-- from onload_start to allow the client to send the data in batches. The time
+-- to live of the keys that expire is reapplied, reduced by the time elapsed
+-- since it has been captured. The values of collections are appended to the
+-- existing ones, so that a big collection can be sent in multiple batches. If
+-- the session is indexed the keys are added to its index. It returns the number
+-- of keys of the chunk.
+-- TODO: Test if this work with "composite" data types, such as geo sets that
+-- are based on zsets.
+redis.register_function('onload_data', function(keys, args)
+    -- Args.
+    local session_id = args[1]
+    local data = cjson.decode(args[2])
+    -- Check that the keys of the session are declared.
+    assert_declared_keys(keys, session_keys(session_id))
+    -- The keys of the session data, that must be declared.
+    local data_key = declared_session_data_key_mapper(keys, session_id)
+    -- Metadata.
+    local metadata_key = session_metadata_key(session_id)
+    -- Get the current state.
+    local result = redis.call('HMGET', metadata_key, 'state', 'indexed')
+    local state, index = result[1], result[2] == '1'
+
+    -- If session is not ONLOADING, return an error.
+    if state ~= 'ONLOADING' then
+        return state_error_reply(session_id, state, 'ONLOADING')
+    end
+
+    -- List of key-value pairs of type string.
+    local strings = data['string'] or {}
+    -- Set the session data.
+    for key, value in pairs(strings) do
+        redis.call('SET', data_key(key), value)
+    end
+
+    -- List of key-value pairs of type list.
+    local lists = data['list'] or {}
+    -- Set the session data.
+    for key, value in pairs(lists) do
+        add_in_batches('RPUSH', data_key(key), value)
+    end
+
+    -- List of key-value pairs of type set.
+    local sets = data['set'] or {}
+    -- Set the session data.
+    for key, value in pairs(sets) do
+        add_in_batches('SADD', data_key(key), value)
+    end
+
+    -- List of key-value pairs of type sorted set.
+    local sortedSets = data['zset'] or {}
+    -- Set the session data.
+    for key, value in pairs(sortedSets) do
+        -- Values map each member to its score (or are encoded as returned by
+        -- ZRANGE WITHSCORES by older nodes), while ZADD expects (score, member).
+        local scoreMembers = {}
+        for member, score in pairs(map_or_flat_to_map(value)) do
+            table.insert(scoreMembers, score)
+            table.insert(scoreMembers, member)
+        end
+        add_in_batches('ZADD', data_key(key), scoreMembers)
+    end
+
+    -- List of key-value pairs of type hash.
+    local hashes = data['hash'] or {}
+    -- Set the session data.
+    for key, value in pairs(hashes) do
+        -- Values map each field to its value (or are encoded as returned by
+        -- HGETALL by older nodes).
+        local fieldValues = {}
+        for field, field_value in pairs(map_or_flat_to_map(value)) do
+            table.insert(fieldValues, field)
+            table.insert(fieldValues, field_value)
+        end
+        add_in_batches('HSET', data_key(key), fieldValues)
+    end
+
+    -- The keys of the chunk.
+    local chunk_keys = {}
+    for _, entries in ipairs({ strings, lists, sets, sortedSets, hashes }) do
+        for key in pairs(entries) do
+            table.insert(chunk_keys, key)
+        end
+    end
+
+    -- Add the keys to the index of the session data keys, if indexed.
+    if index then
+        add_in_batches('SADD', session_keys_index_key(session_id), chunk_keys)
+    end
+
+    -- The time elapsed since the time to live has been captured. It is never
+    -- negative, so that a clock skew between the nodes never extends it.
+    local time = redis.call('TIME')
+    local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+    local elapsed = math.max(0, now - (tonumber(data['time']) or now))
+    -- List of the remaining time to live of the keys that expire.
+    local pttls = data['pttl'] or {}
+    -- Set the expiration of the session data.
+    for key, pttl in pairs(pttls) do
+        local remaining = tonumber(pttl) - elapsed
+        if remaining > 0 then
+            redis.call('PEXPIRE', data_key(key), string.format('%d', remaining))
+        else
+            -- The key expired during the transfer.
+            redis.call('DEL', data_key(key))
+            redis.call('SREM', session_keys_index_key(session_id), key)
+        end
+    end
+
+    -- Return the number of keys of the chunk.
+    return #chunk_keys
+end)
+
+-- Function that restore a chunk of the session data after onload, as dumped by
+-- offload_dump. Args are the session id and a flat list of key, remaining time
+-- to live in milliseconds (0 if the key does not expire) and DUMP payload. Unlike onload_data, any value is restored byte for byte. If the
+-- session is indexed the keys are added to its index.
+redis.register_function('onload_restore', function(keys, args)
+    -- Args.
+    local session_id = args[1]
+    -- Check that the keys of the session are declared.
+    assert_declared_keys(keys, session_keys(session_id))
+    -- The keys of the session data, that must be declared.
+    local data_key = declared_session_data_key_mapper(keys, session_id)
+    -- Metadata.
+    local metadata_key = session_metadata_key(session_id)
+    -- Get the current state.
+    local result = redis.call('HMGET', metadata_key, 'state', 'indexed')
+    local state, index = result[1], result[2] == '1'
+
+    -- If session is not ONLOADING, return an error.
+    if state ~= 'ONLOADING' then
+        return state_error_reply(session_id, state, 'ONLOADING')
+    end
+
+    -- Check if the records are valid.
+    if (#args - 1) % 3 ~= 0 then
+        return error_reply(error_codes.INVALID_ARGUMENT, 'records must be a list of key, expiration and payload')
+    end
+
+    for i = 2, #args, 3 do
+        local key, pttl, payload = args[i], args[i + 1], args[i + 2]
+
+        if tonumber(pttl) == nil or tonumber(pttl) < 0 then
+            return error_reply(error_codes.INVALID_ARGUMENT, 'time to live of ' .. key .. ' is not valid, got ' .. pttl)
+        end
+
+        redis.call('RESTORE', data_key(key), pttl, payload, 'REPLACE')
+
+        -- Add the key to the index of the session data keys, if indexed and
+        -- actually restored.
+        if index and redis.call('EXISTS', data_key(key)) == 1 then
+            redis.call('SADD', session_keys_index_key(session_id), key)
+        end
+    end
+
+    -- Return OK.
+    return 'OK'
+end)
+
+-- Function that set the session as active after onload. The optional args are
+-- the id of the node that offloaded the session and the id of the session on
+-- it, that are the previous location of the session, notified once the session
+-- is offloaded again.
+redis.register_function('onload_finish', function(keys, args)
+    -- Args.
+    local session_id = args[1]
+    local previous_node = args[2] or ""
+    local previous_session = args[3] or ""
+    -- Check that the previous location is valid, if any. A location without
+    -- the node (e.g. offloaded by a node without a current node) cannot be
+    -- notified, so it is not recorded.
+    if previous_node == "" or previous_session == "" then
+        previous_node, previous_session = "", ""
+    else
+        assert_valid_id(previous_node)
+        assert_valid_id(previous_session)
+    end
+    -- Check that the keys of the session are declared.
+    assert_declared_keys(keys, session_keys(session_id))
+    -- Metadata.
+    local metadata_key = session_metadata_key(session_id)
+    -- Get the current state.
+    local state = redis.call('HGET', metadata_key, 'state')
+
+    -- If session is not ONLOADING, return an error.
+    if state ~= 'ONLOADING' then
+        return state_error_reply(session_id, state, 'ONLOADING')
+    end
+
+    -- Set the session metadata attributes.
+    redis.call('HMSET', metadata_key,
+        'state', 'ACTIVE',
+        'previous_node', previous_node,
+        'previous_session', previous_session)
+    touch_session(metadata_key)
+
+    -- Return OK.
+    return 'OK'
+end)
+
+-- Function that cancel the onload of a session, that is marked as DELETING so
+-- that its data is deleted with delete_chunk.
+redis.register_function('onload_cancel', function(keys, args)
+    -- Args.
+    local session_id = args[1]
+    -- Check that the keys of the session are declared.
+    assert_declared_keys(keys, session_keys(session_id))
+    -- Metadata.
+    local metadata_key = session_metadata_key(session_id)
+    -- Get the current state.
+    local state = redis.call('HGET', metadata_key, 'state')
+
+    -- If session is not ONLOADING, return an error.
+    if state ~= 'ONLOADING' then
+        return state_error_reply(session_id, state, 'ONLOADING')
+    end
+
+    -- Mark the session as deleting.
+    redis.call('HSET', metadata_key, 'state', 'DELETING')
+    touch_session(metadata_key)
+
+    -- Return OK.
+    return 'OK'
+end)
+
+-- Function that acquire a session.
+redis.register_function('acquire_session', function(keys, args)
+    -- Args.
+    local session_id = args[1]
+    local allow_offloading = args[2]
+    local allow_while_offloading = args[3]
+    -- Check that the keys of the session are declared.
+    assert_declared_keys(keys, session_keys(session_id))
+    -- Metadata.
+    local metadata_key = session_metadata_key(session_id)
+
+    -- Get the current state.
+    local result = redis.call('HMGET', metadata_key, 'state', 'non_offloadable_uses', 'offloadable_uses',
+        'offloaded_to_host', 'offloaded_to_session', 'expires_at')
+    local state, non_offloadable_uses, offloadable_uses, offloaded_to_host, offloaded_to_session, expires_at =
+        result[1], result[2], result[3], result[4], result[5], result[6]
+
+    -- Parse the values.
+    non_offloadable_uses, offloadable_uses = tonumber(non_offloadable_uses), tonumber(offloadable_uses)
+    -- Get the current time.
+    local time = tonumber(redis.call('TIME')[1])
+
+    -- If session is OFFLOADED, return the state of the session and the offloadedTo data.
+    if state == 'OFFLOADED' then
+        -- The client is being redirected to the new location.
+        redis.call('HSET', metadata_key, 'redirected', '1')
+        return { state, offloaded_to_host, offloaded_to_session }
+    end
+
+    -- If session does not exist (or is not visible), return an error.
+    if state ~= 'ACTIVE' and state ~= 'OFFLOADING' then
+        return error_reply(error_codes.NOT_FOUND, 'session ' .. session_id .. ' does not exist')
+    end
+
+    -- If session is OFFLOADING and it cannot be acquired while offloading, return an error.
+    if allow_while_offloading ~= '1' and state == 'OFFLOADING' then
+        return error_reply(error_codes.OFFLOADING, 'session ' .. session_id .. ' is offloading')
+    end
+
+    -- If session is expired, return an error.
+    if tonumber(expires_at) ~= nil and tonumber(expires_at) < time then
+        return error_reply(error_codes.EXPIRED, 'session ' .. session_id .. ' expired at ' .. expires_at)
+    end
+
+    -- Update use based on offloadable.
+    if allow_offloading ~= '1' then
+        non_offloadable_uses = non_offloadable_uses + 1
+    else
+        offloadable_uses = offloadable_uses + 1
+    end
+
+    -- Set the session metadata attributes.
+    redis.call('HMSET', metadata_key,
+        'non_offloadable_uses', tostring(non_offloadable_uses),
+        'offloadable_uses', tostring(offloadable_uses),
+        'updated_at', tostring(time))
+    touch_session(metadata_key)
+
+    -- Return OK.
+    return { state }
+end)
+
+-- Function that release a previously acquired session. If the session has
+-- been offloaded while acquired, it returns the state of the session and the
+-- offloadedTo data.
+redis.register_function('release_session', function(keys, args)
+    -- Args.
+    local session_id = args[1]
+    local allow_offloading = args[2]
+    -- Check that the keys of the session are declared.
+    assert_declared_keys(keys, session_keys(session_id))
+    -- Metadata.
+    local metadata_key = session_metadata_key(session_id)
+    -- Get the current state.
+    local result = redis.call('HMGET', metadata_key, 'state', 'offloaded_to_host', 'offloaded_to_session',
+        'non_offloadable_uses', 'offloadable_uses')
+    local state, offloaded_to_host, offloaded_to_session, non_offloadable_uses, offloadable_uses =
+        result[1], result[2], result[3], result[4], result[5]
+
+    -- If session does not exist, return an error.
+    if not state then
+        return error_reply(error_codes.NOT_FOUND, 'session ' .. session_id .. ' does not exist')
+    end
+
+    -- Parse the values.
+    non_offloadable_uses, offloadable_uses = tonumber(non_offloadable_uses), tonumber(offloadable_uses)
+    -- Get the current time.
+    local time = redis.call('TIME')[1]
+
+    -- Update use based on offloadable.
+    if allow_offloading ~= '1' then
+        -- If there are no non_offloadable_uses, return an error.
+        if non_offloadable_uses == 0 then
+            return error_reply(error_codes.NO_ACQUISITION, 'session ' .. session_id .. ' has no non_offloadable_uses')
+        end
+
+        -- Update use based on offloadable.
+        non_offloadable_uses = non_offloadable_uses - 1
+    else
+        -- If there are no offloadable_uses, return an error.
+        if offloadable_uses == 0 then
+            return error_reply(error_codes.NO_ACQUISITION, 'session ' .. session_id .. ' has no offloadable_uses')
+        end
+
+        -- Update use based on offloadable.
+        offloadable_uses = offloadable_uses - 1
+    end
+
+    -- Set the session metadata attributes.
+    redis.call('HMSET', metadata_key,
+        'non_offloadable_uses', tostring(non_offloadable_uses),
+        'offloadable_uses', tostring(offloadable_uses),
+        'updated_at', time)
+    touch_session(metadata_key)
+
+    if state == 'OFFLOADED' then
+        return { state, offloaded_to_host, offloaded_to_session }
+    else
+        return { state }
+    end
+end)
+
+-- Function that start the offload of a session. It returns the metadata of the
+-- session (client_lat, client_long, created_in, created_at, updated_at and
+-- expires_at), that describe the offloaded session data.
+redis.register_function('offload_start', function(keys, args)
+    -- Args.
+    local session_id = args[1]
+    -- Check that the keys of the session are declared.
+    assert_declared_keys(keys, session_keys(session_id))
+    -- Metadata.
+    local metadata_key = session_metadata_key(session_id)
+    -- Get the current state.
+    local result = redis.call('HMGET', metadata_key, 'state', 'non_offloadable_uses', 'expires_at')
+    local state, non_offloadable_uses, expires_at = result[1], tonumber(result[2]), result[3]
+    -- Get the current time.
+    local time = tonumber(redis.call('TIME')[1])
+
+    -- If session is already OFFLOADING, return an error.
+    if state == 'OFFLOADING' then
+        return error_reply(error_codes.OFFLOADING, 'session ' .. session_id .. ' is offloading')
+    end
+
+    -- If session is not ACTIVE, return an error.
+    if state ~= 'ACTIVE' then
+        return state_error_reply(session_id, state, 'ACTIVE')
+    end
+
+    -- If session has non_offloadable_uses, return an error.
+    if non_offloadable_uses ~= 0 then
+        return error_reply(error_codes.OFFLOAD_ACQUIRED, 'session ' .. session_id .. ' has non_offloadable_uses')
+    end
+
+    -- If session is expired, return an error.
+    if tonumber(expires_at) ~= nil and tonumber(expires_at) < time then
+        return error_reply(error_codes.EXPIRED, 'session ' .. session_id .. ' expired at ' .. expires_at)
+    end
+
+    -- Set the session metadata attributes.
+    redis.call('HMSET', metadata_key,
+        'state', 'OFFLOADING')
+    touch_session(metadata_key)
+
+    -- Get the metadata, missing fields are returned as empty strings.
+    local metadata = redis.call('HMGET', metadata_key,
+        'client_lat', 'client_long', 'created_in', 'created_at', 'updated_at', 'expires_at')
+    for i = 1, 6 do
+        metadata[i] = metadata[i] or ""
+    end
+
+    -- Return the metadata.
+    return metadata
+end)
+
+-- Function that offload a chunk of the data of a session. The keys of the
+-- session data to read are declared after the keys of the session, in order,
+-- as returned by scan_session_data, and the sub cursor is the cursor within
+-- the first of them ('0' or empty to start it). Lists, sets, sorted sets and
+-- hashes are read in pages, so that a big collection is split over multiple
+-- chunks, whose values are appended to the same key by onload_data. Keys and
+-- pages are added to the chunk until its estimated size reaches the given size
+-- in bytes (default 1 MiB), strings are never split, so a big string may exceed
+-- it. The chunk includes the remaining time to live of the keys that expire.
+-- Hashes map each field to its value and sorted sets map each member to its
+-- score. It returns the number of declared keys that have been read completely,
+-- the sub cursor within the next one, the json of the chunk and the keys in it.
+-- TODO: Test if this work with "composite" data types, such as geo sets that
+-- are based on zsets.
+redis.register_function('offload_data', function(keys, args)
+    -- Args.
+    local session_id = args[1]
+    local sub_cursor = args[2] ~= "" and args[2] or '0'
+    local chunk_size = tonumber(args[3] ~= nil and args[3] ~= "" and args[3] or 1048576)
+    -- Check that the keys of the session are declared.
+    assert_declared_keys(keys, session_keys(session_id))
+    -- The keys of the session data to read.
+    local pending = declared_session_data_keys(keys, session_id)
+    -- Metadata.
+    local metadata_key = session_metadata_key(session_id)
+    -- Get the current state.
+    local state = redis.call('HGET', metadata_key, 'state')
+
+    -- Check that the chunk size is a positive number.
+    if chunk_size == nil or chunk_size <= 0 then
+        return error_reply(error_codes.INVALID_ARGUMENT, 'chunk size must be a positive number, got ' .. args[3])
+    end
+
+    -- Check the sub cursor.
+    if not string.match(sub_cursor, "^%d+$") then
+        return error_reply(error_codes.INVALID_CURSOR, 'sub cursor must be a number, got ' .. sub_cursor)
+    end
+
+    -- If session is not OFFLOADING, return an error.
+    if state ~= 'OFFLOADING' then
+        return state_error_reply(session_id, state, 'OFFLOADING')
+    end
+
+    -- Get the current time in milliseconds.
+    local time = redis.call('TIME')
+    local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+    -- TODO: We build the strcut and then we encode it, we should build it
+    -- directly in the encoded format.
+    local data = {
+        string = {},
+        list = {},
+        set = {},
+        zset = {},
+        hash = {},
+        -- The remaining time to live in milliseconds of the keys that expire,
+        -- captured at the given time.
+        pttl = {},
+        time = now
+    }
+
+    -- Capture the remaining time to live of a key, if it expires.
+    local function capture_pttl(key)
+        local pttl = redis.call('PTTL', key)
+        if pttl > 0 then
+            data['pttl'][extract_key_from_session_data_key(session_id, key)] = pttl
+        end
+    end
+
+    -- Readers by type, each one reads a page of about count elements of a key
+    -- starting from the sub cursor. They return the elements, as a flat list
+    -- for sorted sets and hashes, the number of elements and the next sub
+    -- cursor, nil once the whole value has been read.
+    local readers = {
+        -- Strings are read as a whole.
+        string = function(key, sub, count)
+            return redis.call('GET', key), 1, nil
+        end,
+        -- Lists are read by range, the sub cursor is the index of the page.
+        list = function(key, sub, count)
+            local start = tonumber(sub)
+            local values = redis.call('LRANGE', key, start, start + count - 1)
+            return values, #values, #values == count and tostring(start + count) or nil
+        end,
+        -- Sets, sorted sets and hashes are scanned, the sub cursor is the
+        -- cursor of the scan. Elements returned twice are added only once.
+        set = function(key, sub, count)
+            local result = redis.call('SSCAN', key, sub, 'COUNT', count)
+            return result[2], #result[2], result[1] ~= '0' and result[1] or nil
+        end,
+        zset = function(key, sub, count)
+            local result = redis.call('ZSCAN', key, sub, 'COUNT', count)
+            return result[2], #result[2] / 2, result[1] ~= '0' and result[1] or nil
+        end,
+        hash = function(key, sub, count)
+            local result = redis.call('HSCAN', key, sub, 'COUNT', count)
+            return result[2], #result[2] / 2, result[1] ~= '0' and result[1] or nil
+        end
+    }
+
+    -- The number of keys in the chunk and its estimated size in bytes, that
+    -- counts the strings of the chunk plus the quotes and the separator of
+    -- each one of them.
+    local total, size = 0, 0
+
+    -- Add a page of elements of a key to the chunk, appending it to the pages
+    -- already added.
+    local function add_page(type_name, key, values)
+        local session_key = extract_key_from_session_data_key(session_id, key)
+        local entries = data[type_name]
+        if entries[session_key] == nil then
+            entries[session_key] = type_name == 'string' and values or {}
+            total, size = total + 1, size + #session_key + 4
+        end
+        if type_name == 'string' then
+            size = size + #values + 3
+        elseif type_name == 'list' or type_name == 'set' then
+            for _, value in ipairs(values) do
+                table.insert(entries[session_key], value)
+                size = size + #value + 3
+            end
+        else
+            for i = 1, #values, 2 do
+                entries[session_key][values[i]] = values[i + 1]
+                size = size + #values[i] + #values[i + 1] + 6
+            end
+        end
+        capture_pttl(key)
+    end
+
+    -- The number of elements read at once.
+    local page_size = 100
+    -- The number of pending keys that have been read completely.
+    local consumed = 0
+
+    while size < chunk_size and consumed < #pending do
+        -- Read a page of the first pending key, missing keys and keys of other
+        -- types are skipped.
+        local key = pending[consumed + 1]
+        local type_name = redis.call('TYPE', key)['ok']
+        local values, read, next_sub_cursor = nil, 0, nil
+        if readers[type_name] then
+            values, read, next_sub_cursor = readers[type_name](key, sub_cursor, page_size)
+        end
+        if values and read > 0 then
+            add_page(type_name, key, values)
+        end
+
+        -- Move to the next pending key once the whole value has been read.
+        if next_sub_cursor == nil then
+            consumed = consumed + 1
+            sub_cursor = '0'
+        else
+            sub_cursor = next_sub_cursor
+        end
+    end
+
+    -- The keys of the chunk.
+    local chunk_keys = {}
+    for _, name in ipairs({ 'string', 'list', 'set', 'zset', 'hash' }) do
+        for key in pairs(data[name]) do
+            table.insert(chunk_keys, key)
+        end
+    end
+
+    -- Remove the empty tables, that would be encoded as json arrays.
+    for name, value in pairs(data) do
+        if type(value) == 'table' and next(value) == nil then
+            data[name] = nil
+        end
+    end
+
+    -- Return the number of keys read, the sub cursor, the data and its keys.
+    return { consumed, sub_cursor, cjson.encode(data), chunk_keys }
+end)
+
+-- Function that offload a chunk of the data of a session as DUMP payloads. The
+-- keys of the session data to dump are declared after the keys of the session,
+-- in order, and they are dumped until the size of the payloads reaches the
+-- given size in bytes (default 1 MiB), at least one key is dumped. It returns
+-- the number of declared keys that have been dumped and a flat list of key,
+-- remaining time to live in milliseconds (0 if the key does not expire) and
+-- DUMP payload. The time to live is relative, so that it does not depend on the
+-- clocks of the nodes. Unlike offload_data, it supports any type of value and it is
+-- binary safe, but the payloads can be restored only by servers with a
+-- compatible RDB version.
+redis.register_function('offload_dump', function(keys, args)
+    -- Args.
+    local session_id = args[1]
+    local chunk_size = tonumber(args[2] ~= nil and args[2] ~= "" and args[2] or 1048576)
+    -- Check that the keys of the session are declared.
+    assert_declared_keys(keys, session_keys(session_id))
+    -- The keys of the session data to dump.
+    local pending = declared_session_data_keys(keys, session_id)
+    -- Metadata.
+    local metadata_key = session_metadata_key(session_id)
+    -- Get the current state.
+    local state = redis.call('HGET', metadata_key, 'state')
+
+    -- Check that the chunk size is a positive number.
+    if chunk_size == nil or chunk_size <= 0 then
+        return error_reply(error_codes.INVALID_ARGUMENT, 'chunk size must be a positive number, got ' .. args[2])
+    end
+
+    -- If session is not OFFLOADING, return an error.
+    if state ~= 'OFFLOADING' then
+        return state_error_reply(session_id, state, 'OFFLOADING')
+    end
+
+    local records, size, consumed = {}, 0, 0
+    while size < chunk_size and consumed < #pending do
+        local key = pending[consumed + 1]
+        local pttl = redis.call('PTTL', key)
+        local payload = redis.call('DUMP', key)
+
+        -- Keys that expired in the meanwhile are skipped.
+        if payload then
+            -- A key about to expire keeps at least 1 ms, as 0 means no expiry.
+            -- The size counts the key as it is sent, without the prefix.
+            local session_key = extract_key_from_session_data_key(session_id, key)
+            table.insert(records, session_key)
+            table.insert(records, string.format('%d', pttl >= 0 and math.max(pttl, 1) or 0))
+            table.insert(records, payload)
+            size = size + #session_key + #payload
+        end
+
+        consumed = consumed + 1
+    end
+
+    -- Return the number of keys dumped and the records.
+    return { consumed, records }
+end)
+
+-- Function that finish the offload of a session. It returns the previous
+-- location of the session, that is the id of the node that offloaded it to the
+-- current one and the id of the session on it (empty if the session has not
+-- been onloaded), that must be pointed to the new location.
+redis.register_function('offload_finish', function(keys, args)
+    -- Args.
+    local session_id = args[1]
+    local offloaded_to_host = args[2]
+    local offloaded_to_session = args[3]
+    -- Check that the keys of the session are declared.
+    assert_declared_keys(keys, session_keys(session_id))
+    -- Metadata.
+    local metadata_key = session_metadata_key(session_id)
+    -- Get the current state.
+    local result = redis.call('HMGET', metadata_key, 'state', 'previous_node', 'previous_session')
+    local state, previous_node, previous_session = result[1], result[2], result[3]
+
+    -- If session is not OFFLOADING, return an error.
+    if state ~= 'OFFLOADING' then
+        return state_error_reply(session_id, state, 'OFFLOADING')
+    end
+
+    -- Set the session metadata attributes.
+    redis.call('HMSET', metadata_key,
+        'state', 'OFFLOADED',
+        'offloaded_to_host', offloaded_to_host,
+        'offloaded_to_session', offloaded_to_session,
+        'redirected', '0')
+    touch_session(metadata_key)
+
+    -- Return the previous location.
+    return { previous_node or "", previous_session or "" }
+end)
+
+-- Function that update the location of an offloaded session, when the session
+-- has been offloaded again from its new location. It returns 1 if a client has
+-- been redirected to the previous location (0 otherwise), in that case the
+-- previous location is the last visited one.
+redis.register_function('update_offloaded_location', function(keys, args)
+    -- Args.
+    local session_id = args[1]
+    local offloaded_to_host = args[2]
+    local offloaded_to_session = args[3]
+    -- Check that the keys of the session are declared.
+    assert_declared_keys(keys, session_keys(session_id))
+    -- Metadata.
+    local metadata_key = session_metadata_key(session_id)
+    -- Get the current state.
+    local result = redis.call('HMGET', metadata_key, 'state', 'redirected')
+    local state, redirected = result[1], result[2]
+
+    -- If session does not exist, return an error.
+    if not state then
+        return error_reply(error_codes.NOT_FOUND, 'session ' .. session_id .. ' does not exist')
+    end
+
+    -- If session is not OFFLOADED, return an error.
+    if state ~= 'OFFLOADED' then
+        return error_reply(error_codes.NOT_OFFLOADED, 'session ' .. session_id .. ' is ' .. state)
+    end
+
+    -- Point to the new location, the redirections are counted from now on.
+    redis.call('HMSET', metadata_key,
+        'offloaded_to_host', offloaded_to_host,
+        'offloaded_to_session', offloaded_to_session,
+        'redirected', '0')
+
+    -- Return whether a client has been redirected to the previous location.
+    return redirected == '1' and 1 or 0
+end)
+
+-- Function that cancel the offload of a session, that becomes ACTIVE again.
+redis.register_function('offload_cancel', function(keys, args)
+    -- Args.
+    local session_id = args[1]
+    -- Check that the keys of the session are declared.
+    assert_declared_keys(keys, session_keys(session_id))
+    -- Metadata.
+    local metadata_key = session_metadata_key(session_id)
+    -- Get the current state.
+    local state = redis.call('HGET', metadata_key, 'state')
+
+    -- If session is not OFFLOADING, return an error.
+    if state ~= 'OFFLOADING' then
+        return state_error_reply(session_id, state, 'OFFLOADING')
+    end
+
+    -- Set the session metadata attributes.
+    redis.call('HMSET', metadata_key, 'state', 'ACTIVE')
+    touch_session(metadata_key)
+
+    -- Return OK.
+    return 'OK'
+end)
+
+-- Function that set the metadata of a session in a single step, so that an
+-- update is never applied partially. Args are the session id, the flag '1' if
+-- the coordinates of the client must be set followed by the latitude and the
+-- longitude (empty to unset them), and the flag '1' if the expiration time must
+-- be set followed by the expiration time (empty if the session does not expire)
+-- and the expired flag, that when set to '1' makes the session expire
+-- immediately.
+redis.register_function('set_session_metadata', function(keys, args)
+    -- Args.
+    local session_id = args[1]
+    local set_coordinates = args[2] == '1'
+    local client_lat = args[3]
+    local client_long = args[4]
+    local set_expiration = args[5] == '1'
+    local expires_at = args[6]
+    local expired = args[7]
+    -- Check that the keys of the session are declared.
+    assert_declared_keys(keys, session_keys(session_id))
+    -- Metadata.
+    local metadata_key = session_metadata_key(session_id)
+    -- Get the current time.
+    local time = redis.call('TIME')[1]
+
+    -- Check if the arguments are valid before changing anything.
+    if set_coordinates and (client_lat ~= "" or client_long ~= "") then
+        -- Check if the client coordinates are valid.
+        assert_valid_geo_coordinates(client_lat, client_long)
+    end
+    if set_expiration then
+        if expired == '1' then
+            -- The session expires now.
+            expires_at = time
+        elseif expires_at ~= "" then
+            -- Check if the expires_at is valid.
+            assert_valid_timestamp_string_greater_than(expires_at, time)
+        end
+    end
+
+    -- Get the current state.
+    local state = redis.call('HGET', metadata_key, 'state')
+
+    -- If session does not exist, return an error.
+    if not state then
+        return error_reply(error_codes.NOT_FOUND, 'session ' .. session_id .. ' does not exist')
+    end
+
+    -- Nothing to change, the session is left untouched.
+    if not set_coordinates and not set_expiration then
+        return true
+    end
+
+    if set_coordinates then
+        -- Set the coordinates of the client.
+        redis.call('HMSET', metadata_key,
+            'client_lat', client_lat,
+            'client_long', client_long)
+    end
+
+    if set_expiration then
+        -- Set the expiration time.
+        redis.call('HSET', metadata_key, 'expires_at', expires_at)
+    end
+
+    -- Set the update time.
+    redis.call('HSET', metadata_key, 'updated_at', time)
+    touch_session(metadata_key)
+
+    -- Return true.
+    return true
+end)
+
+-- Function that return the metadata of a session as a list of strings, in the
+-- order: client_lat, client_long, created_in, created_at, updated_at and
+-- expires_at.
+redis.register_function('get_session_metadata', function(keys, args)
+    -- Args.
+    local session_id = args[1]
+    -- Check that the keys of the session are declared.
+    assert_declared_keys(keys, session_keys(session_id))
+    -- Metadata.
+    local metadata_key = session_metadata_key(session_id)
+
+    -- If session does not exist, return an error.
+    if redis.call('EXISTS', metadata_key) == 0 then
+        return error_reply(error_codes.NOT_FOUND, 'session ' .. session_id .. ' does not exist')
+    end
+
+    -- Get the metadata, missing fields are returned as empty strings.
+    local result = redis.call('HMGET', metadata_key,
+        'client_lat', 'client_long', 'created_in', 'created_at', 'updated_at', 'expires_at')
+    for i = 1, 6 do
+        result[i] = result[i] or ""
+    end
+
+    -- Return the metadata.
+    return result
+end)
+
+-- Function that return the resources usage of a session as a flat list of
+-- resource and usage pairs. The resources usage is kept in the index of the
+-- node, so the session must have been synced in it.
+redis.register_function('get_session_resources_usage', function(keys, args)
+    -- Args.
+    local session_id = args[1]
+    -- Check that the keys of the index are declared.
+    assert_declared_keys(keys, sessions_index_keys)
+
+    -- If session does not exist, return an error.
+    if not session_index_entry(session_id) then
+        return error_reply(error_codes.NOT_FOUND, 'session ' .. session_id .. ' does not exist')
+    end
+
+    -- The resources usage as a flat list.
+    local usage = {}
+    for resource, value in pairs(cjson.decode(redis.call('HGET', sessions_resources, session_id) or '{}')) do
+        table.insert(usage, resource)
+        table.insert(usage, value)
+    end
+
+    -- Return the resources usage.
+    return usage
+end)
+
+-- Function that run a command on a key of the session data, given without the
+-- prefix of the session keyspace and declared after the keys of the session.
+-- Args are the session id, the command, the key and the other arguments of the
+-- command, that must take the key as its first argument and no other key. If
+-- the session is indexed, the key is added to its index if it exists after the
+-- command and removed otherwise, in the same call, so that the index never
+-- misses a key written through this function. It returns the reply of the
+-- command.
+redis.register_function('session_data_command', function(keys, args)
+    -- Args.
+    local session_id = args[1]
+    local command = args[2]
+    local key = args[3]
+    -- Check that the keys of the session are declared.
+    assert_declared_keys(keys, session_keys(session_id))
+
+    -- Check if the command and the key are valid.
+    if command == nil or command == "" or key == nil or key == "" then
+        return error_reply(error_codes.INVALID_ARGUMENT, 'command and key cannot be empty')
+    end
+
+    -- The key of the session data, that must be declared.
+    local data_key = declared_session_data_key_mapper(keys, session_id)(key)
+    -- Get the current state.
+    local result = redis.call('HMGET', session_metadata_key(session_id), 'state', 'indexed')
+    local state, indexed = result[1], result[2] == '1'
+
+    -- If session is not ACTIVE, return an error.
+    if state ~= 'ACTIVE' then
+        return state_error_reply(session_id, state, 'ACTIVE')
+    end
+
+    -- Run the command.
+    local reply = redis.call(command, data_key, unpack(args, 4))
+
+    -- Keep the index in sync with the key.
+    if indexed then
+        if redis.call('EXISTS', data_key) == 1 then
+            redis.call('SADD', session_keys_index_key(session_id), key)
+        else
+            redis.call('SREM', session_keys_index_key(session_id), key)
+        end
+    end
+
+    -- Return the reply of the command.
+    return reply
+end)
+
+-- Function that estimate the memory used by the keys of the session data that
+-- are declared after the keys of the session, as returned by
+-- scan_session_data. It returns the bytes used by the keys and their number.
+redis.register_function('estimate_session_size', function(keys, args)
+    -- Args.
+    local session_id = args[1]
+    -- Check that the keys of the session are declared.
+    assert_declared_keys(keys, session_keys(session_id))
+    -- The keys of the session data to estimate.
+    local data_keys = declared_session_data_keys(keys, session_id)
+
+    -- If session does not exist, return an error.
+    if redis.call('EXISTS', session_metadata_key(session_id)) == 0 then
+        return error_reply(error_codes.NOT_FOUND, 'session ' .. session_id .. ' does not exist')
+    end
+
+    -- Sum the memory used by the keys, missing keys are skipped.
+    local bytes, count = 0, 0
+    for _, key in ipairs(data_keys) do
+        local usage = redis.call('MEMORY', 'USAGE', key)
+        if usage then
+            bytes, count = bytes + usage, count + 1
+        end
+    end
+
+    -- Return the bytes and the number of keys.
+    return { bytes, count }
+end)
+
+-- Function that set the resources usage of a session, args are the session id
+-- followed by a flat list of resource and usage pairs. Resources that are not given are left unchanged,
+-- while the resources usage of the current node is updated accordingly. The
+-- state of the session is the one synced in the index of the node.
+redis.register_function('update_session_resources_usage', function(keys, args)
+    -- Args.
+    local session_id = args[1]
+    local usage = { unpack(args, 2) }
+    -- Check that the keys of the index are declared.
+    assert_declared_keys(keys, sessions_index_keys)
+    -- Get the current state.
+    local entry = session_index_entry(session_id)
+    local state = entry and entry['state']
+
+    -- If session does not exist, return an error.
+    if not state then
+        return error_reply(error_codes.NOT_FOUND, 'session ' .. session_id .. ' does not exist')
+    end
+
+    -- The resources of offloaded and deleting sessions are not accounted.
+    if state == 'OFFLOADED' or state == 'DELETING' then
+        return state_error_reply(session_id, state, 'ACTIVE, OFFLOADING or ONLOADING')
+    end
+
+    -- Check if the usage is valid.
+    if #usage % 2 ~= 0 then
+        return error_reply(error_codes.INVALID_ARGUMENT, 'resources usage must be a list of resource and usage pairs')
+    end
+    for i = 2, #usage, 2 do
+        if tonumber(usage[i]) == nil or tonumber(usage[i]) < 0 then
+            return error_reply(error_codes.INVALID_ARGUMENT, 'usage of ' .. usage[i - 1] .. ' is not valid, got ' .. usage[i])
+        end
+    end
+
+    local session_usage = cjson.decode(redis.call('HGET', sessions_resources, session_id) or '{}')
+    for i = 1, #usage, 2 do
+        local resource, value = usage[i], tonumber(usage[i + 1])
+        -- Update the resources usage of the node by the difference.
+        increment_resources_usage(resource, value - (tonumber(session_usage[resource]) or 0))
+        -- Set the resources usage of the session, as a string so that it is
+        -- never rounded.
+        session_usage[resource] = usage[i + 1]
+    end
+    redis.call('HSET', sessions_resources, session_id, cjson.encode(session_usage))
+
+    -- Return OK.
+    return 'OK'
+end)
+
+-- Return the number of sessions and the resources usage (as a flat list of
+-- resource and usage pairs) of the current node.
+local function current_node_resources_usage()
+    -- The sessions hosted by the node, offloaded ones excluded.
+    local sessions = redis.call('ZCARD', sessions_set) - redis.call('ZCARD', offloaded_sessions_set)
+
+    return sessions, redis.call('HGETALL', resources_usage)
+end
+
+-- Return the number of sessions and the resources usage (as a flat list of
+-- resource and usage pairs) last reported by a node, nil if unknown.
+local function reported_node_resources_usage(node_id)
+    local result = redis.call('HGET', infrastructure_usage, node_id)
+
+    if not result then
+        return nil
+    end
+
+    -- Split the reserved fields from the resources.
+    local sessions, usage = 0, {}
+    for resource, value in pairs(cjson.decode(result)) do
+        if resource == usage_sessions_field then
+            sessions = tonumber(value)
+        elseif resource ~= usage_version_field then
+            table.insert(usage, resource)
+            table.insert(usage, value)
+        end
+    end
+
+    return sessions, usage
+end
+
+-- Return the resources usage last reported by a node as a flat list of
+-- resource and usage pairs, reserved fields included, empty if unknown.
+local function reported_node_resources_usage_flat(node_id)
+    local usage = {}
+    for resource, value in pairs(cjson.decode(redis.call('HGET', infrastructure_usage, node_id) or '{}')) do
+        table.insert(usage, resource)
+        table.insert(usage, value)
+    end
+
+    return usage
+end
+
+-- Function that return the number of sessions and the resources usage of a
+-- node, as a flat list of resource and usage pairs. The usage of the nodes
+-- other than the current one is the last one they reported.
+redis.register_function('get_node_resources_usage', function(keys, args)
+    -- Args.
+    local node_id = args[1]
+    -- Check that the keys of the node are declared.
+    assert_declared_keys(keys, node_usage_keys, infrastructure_keys)
+
+    if node_id == current_node_id() then
+        local sessions, usage = current_node_resources_usage()
+        return { sessions, usage }
+    end
+
+    local sessions, usage = reported_node_resources_usage(node_id)
+
+    -- The node never reported its usage.
+    if not sessions then
+        return error_reply(error_codes.NODE_NOT_FOUND, 'resources usage of node ' .. node_id .. ' is not known')
+    end
+
+    -- Return the number of sessions and the resources usage.
+    return { sessions, usage }
+end)
+
+-- Function that start the deletion of a session, that is marked as DELETING
+-- so that it cannot be used anymore. Its data is then deleted with
+-- delete_chunk. Sessions that are already being deleted are left unchanged.
+redis.register_function('delete_start', function(keys, args)
+    -- Args.
+    local session_id = args[1]
+    -- Check that the keys of the session are declared.
+    assert_declared_keys(keys, session_keys(session_id))
+    -- Metadata.
+    local metadata_key = session_metadata_key(session_id)
+    -- Get the current state.
+    local result = redis.call('HMGET', metadata_key, 'state', 'non_offloadable_uses', 'offloadable_uses')
+    local state, non_offloadable_uses, offloadable_uses = result[1], tonumber(result[2]), tonumber(result[3])
+
+    -- If session is not deletable, return an error.
+    if not state then
+        return error_reply(error_codes.NOT_FOUND, 'session ' .. session_id .. ' does not exist')
+    elseif state == 'DELETING' then
+        return 'OK'
+    elseif state == 'OFFLOADING' then
+        return error_reply(error_codes.OFFLOADING, 'session ' .. session_id .. ' is offloading')
+    elseif state == 'ONLOADING' then
+        return error_reply(error_codes.ONLOADING, 'session ' .. session_id .. ' is onloading')
+    elseif non_offloadable_uses ~= 0 or offloadable_uses ~= 0 then
+        return error_reply(error_codes.ACQUIRED, 'session ' .. session_id .. ' is acquired')
+    end
+
+    -- Mark the session as deleting, so that it cannot be used anymore.
+    redis.call('HSET', metadata_key, 'state', 'DELETING')
+    touch_session(metadata_key)
+
+    -- Return OK.
+    return 'OK'
+end)
+
+-- Function that delete a chunk of a session that is being deleted. The keys of
+-- the session data to delete are declared after the keys of the session, as
+-- returned by scan_session_data. If the final flag is '1', that is the keys are
+-- the last ones of the scan, the session metadata is deleted too. It returns
+-- the number of deleted keys and, once the session has been completely
+-- deleted, the json of its entry in the index of the node, empty otherwise.
+redis.register_function('delete_chunk', function(keys, args)
+    -- Args.
+    local session_id = args[1]
+    local final = args[2] == '1'
+    -- Check that the keys of the session are declared.
+    assert_declared_keys(keys, session_keys(session_id))
+    -- Get the current state.
+    local state = redis.call('HGET', session_metadata_key(session_id), 'state')
+
+    -- If session is not DELETING, return an error.
+    if state ~= 'DELETING' then
+        return state_error_reply(session_id, state, 'DELETING')
+    end
+
+    -- Delete the chunk.
+    return unlink_session_chunk(keys, session_id, final)
+end)
+
+-- Function that return the sessions to garbage collect, at most "count" of
+-- them. Sessions that are not used are collected once expired, while sessions
+-- that are still in use (negative score) are collected only if
+-- ttl_after_expiration is set, and they expired more than ttl_after_expiration
+-- seconds ago. Sessions left DELETING (score 0) are returned first, so that
+-- the deletions that have been interrupted are completed. Only ACTIVE,
+-- OFFLOADED and DELETING sessions are returned, while ONLOADING and OFFLOADING
+-- sessions are never collected. The entries of the sessions deleted more than
+-- deleted_sessions_retention seconds ago are removed as well.
+redis.register_function('collectable_sessions', function(keys, args)
+    -- Args.
+    local ttl_after_expiration = args[1]
+    local count = tonumber(args[2])
+    -- Check that the keys of the index are declared.
+    assert_declared_keys(keys, sessions_index_keys)
+    -- Get the current time.
+    local time = tonumber(redis.call('TIME')[1])
+
+    -- Check if the ttl_after_expiration is valid.
+    if ttl_after_expiration ~= "" and tonumber(ttl_after_expiration) == nil then
+        raise(error_codes.INVALID_ARGUMENT, 'ttl after expiration is not valid, got ' .. ttl_after_expiration)
+    end
+
+    -- Check if the count is valid.
+    if count == nil or count < 1 then
+        return error_reply(error_codes.INVALID_ARGUMENT, 'count must be a positive number, got ' .. tostring(args[2]))
+    end
+
+    -- Remove the entries of the sessions deleted long ago.
+    local deleted = redis.call('ZRANGEBYSCORE', deleted_sessions_set,
+        '-inf', time - deleted_sessions_retention, 'LIMIT', 0, count)
+    if #deleted > 0 then
+        redis.call('HDEL', sessions_index, unpack(deleted))
+        redis.call('ZREM', deleted_sessions_set, unpack(deleted))
+    end
+
+    -- Retrieve the sessions being deleted and the expired ones that are not in use.
+    local expired = redis.call('ZRANGEBYSCORE', sessions_set, '0', time, 'LIMIT', 0, count)
+
+    -- Retrieve the expired sessions that are still in use.
+    if #expired < count and ttl_after_expiration ~= "" then
+        local used = redis.call('ZRANGEBYSCORE', sessions_set,
+            '(' .. -(time - tonumber(ttl_after_expiration)), '(0', 'LIMIT', 0, count - #expired)
+        for _, session_id in ipairs(used) do
+            table.insert(expired, session_id)
+        end
+    end
+
+    -- Keep the sessions in a collectable state only.
+    local sessions = {}
+    for _, session_id in ipairs(expired) do
+        local entry = session_index_entry(session_id)
+        local state = entry and entry['state']
+        if state == 'ACTIVE' or state == 'OFFLOADED' or state == 'DELETING' then
+            table.insert(sessions, session_id)
+        end
+    end
+
+    -- Return the sessions.
+    return sessions
+end)
+
+-- Function that mark a session returned by collectable_sessions as DELETING,
+-- if it is still collectable, that is ACTIVE or OFFLOADED and expired as
+-- described by collectable_sessions, or already DELETING. Its data is then
+-- deleted with delete_chunk. It returns 1 if the session is being deleted, 0
+-- otherwise.
+redis.register_function('collect_session', function(keys, args)
+    -- Args.
+    local session_id = args[1]
+    local ttl_after_expiration = args[2]
+    -- Check that the keys of the session are declared.
+    assert_declared_keys(keys, session_keys(session_id))
+    -- Metadata.
+    local metadata_key = session_metadata_key(session_id)
+    -- Get the current state.
+    local result = redis.call('HMGET', metadata_key, 'state', 'non_offloadable_uses', 'offloadable_uses', 'expires_at')
+    local state, uses, expires_at = result[1], (tonumber(result[2]) or 0) + (tonumber(result[3]) or 0),
+        tonumber(result[4])
+    -- Get the current time.
+    local time = tonumber(redis.call('TIME')[1])
+
+    -- If session does not exist, return an error.
+    if not state then
+        return error_reply(error_codes.NOT_FOUND, 'session ' .. session_id .. ' does not exist')
+    end
+
+    -- The deletion has been interrupted.
+    if state == 'DELETING' then
+        return 1
+    end
+
+    -- Check if the session is still collectable.
+    if state ~= 'ACTIVE' and state ~= 'OFFLOADED' or not expires_at or expires_at > time then
+        return 0
+    end
+    if uses > 0 and (ttl_after_expiration == "" or expires_at >= time - tonumber(ttl_after_expiration)) then
+        return 0
+    end
+
+    -- Mark the session as deleting, so that it cannot be used anymore.
+    redis.call('HSET', metadata_key, 'state', 'DELETING')
+    touch_session(metadata_key)
+
+    -- Return 1.
+    return 1
+end)
+
+-- Return the id of the parent of a node, nil if it has no parent.
+local function parent_node(node_id)
+    return redis.call('HGET', infrastructure_parents, node_id) or nil
+end
+
+-- Return the ids of the children of a node. The relations are kept in a single
+-- hash, so that they are on the slot of the node keyspace, and the number of
+-- nodes of an infrastructure is small enough to read it as a whole.
+local function children_nodes(node_id)
+    local parents, children = redis.call('HGETALL', infrastructure_parents), {}
+    for i = 1, #parents, 2 do
+        if parents[i + 1] == node_id then
+            table.insert(children, parents[i])
+        end
+    end
+
+    return children
+end
+
+-- Return the json of a node, nil if it does not exist.
+local function node_json(node_id)
+    return redis.call('HGET', infrastructure_nodes, node_id) or nil
+end
+
+-- Function that create a node and register it.
+redis.register_function('register_node', function(keys, args)
+    -- Args.
+    local node_id = args[1]
+    local jsonNode = args[2]
+    local node = cjson.decode(jsonNode)
+    local coords = node['geoCoordinates']
+
+    -- Check if the node id is valid.
+    assert_valid_id(node_id)
+    -- Check that the keys of the infrastructure are declared.
+    assert_declared_keys(keys, infrastructure_keys)
+    -- Check if the node coordinates are valid.
+    assert_valid_geo_coordinates(coords['latitude'], coords['longitude'])
+
+    -- Add the node to the nodes_geoset.
+    redis.call('GEOADD', nodes_geoset, tostring(coords['longitude'] + 0.0), tostring(coords['latitude'] + 0.0), node_id)
+
+    -- Set the json of the node.
+    redis.call('HSET', infrastructure_nodes, node_id, jsonNode)
+    -- Return OK.
+    return 'OK'
+end)
+
+-- Function that create a node and register it.
+redis.register_function('register_node_relation', function(keys, args)
+    -- Args.
+    local parent_node_id = args[1]
+    local child_node_id = args[2]
+    -- Check that the keys of the infrastructure are declared.
+    assert_declared_keys(keys, infrastructure_keys)
+
+    -- Set the parent-child relation.
+    redis.call('HSET', infrastructure_parents, child_node_id, parent_node_id)
+
+    -- Return OK.
+    return 'OK'
+end)
+
+-- Function that get the json of a node by id.
+redis.register_function('get_node', function(keys, args)
+    -- Args.
+    local node_id = args[1]
+    -- Check that the keys of the infrastructure are declared.
+    assert_declared_keys(keys, infrastructure_keys)
+
+    -- Get the node.
+    local node = node_json(node_id)
+
+    -- If node does not exist, return an error.
+    if not node then
+        return error_reply(error_codes.NODE_NOT_FOUND, 'node ' .. node_id .. ' does not exist')
+    end
+
+    return node
+end)
+
+-- Function that get the node by id.
+redis.register_function('get_parent_node_of', function(keys, args)
+    -- Args.
+    local node_id = args[1]
+    -- Check that the keys of the infrastructure are declared.
+    assert_declared_keys(keys, infrastructure_keys)
+
+    -- Get the parent.
+    local parent = parent_node(node_id)
+
+    -- If parent is nil, return nil.
+    if not parent or parent == "" then
+        return ""
+    end
+
+    return node_json(parent) or ""
+end)
+
+-- Function that get the node by id.
+redis.register_function('get_children_nodes_of', function(keys, args)
+    -- Args.
+    local node_id = args[1]
+    -- Check that the keys of the infrastructure are declared.
+    assert_declared_keys(keys, infrastructure_keys)
+
+    -- Get the json of the children.
+    local ArrayOfJsons = {}
+
+    for _, child in ipairs(children_nodes(node_id)) do
+        table.insert(ArrayOfJsons, node_json(child))
+    end
+
+    -- Return the json.
+    return ArrayOfJsons
+end)
+
+-- Return the ids of the nodes of the subtree rooted at the given node, the
+-- node included.
+local function subtree_nodes(node_id)
+    local nodes, visited, i = { node_id }, { [node_id] = true }, 1
+
+    -- Visit the tree breadth first.
+    while i <= #nodes do
+        for _, child in ipairs(children_nodes(nodes[i])) do
+            if not visited[child] then
+                visited[child] = true
+                table.insert(nodes, child)
+            end
+        end
+        i = i + 1
+    end
+
+    return nodes
+end
+
+-- Return true if the node is a descendant of the ancestor node.
+local function is_descendant_of(node_id, ancestor_id)
+    -- The depth is bounded to stop on cycles.
+    for _ = 1, 64 do
+        node_id = parent_node(node_id)
+
+        if not node_id then
+            return false
+        elseif node_id == ancestor_id then
+            return true
+        end
+    end
+
+    return false
+end
+
+-- Function that compute the update of the resources usage to send to the parent
+-- node. The update maps each node of the subtree of the current node to its
+-- last known absolute usage, that includes the reserved fields with the number
+-- of sessions and the version. Only the usage that changed since the last
+-- delivered update is included, except for the periodic full updates. The
+-- versions of the update are marked as sent only once the update is delivered,
+-- see resources_usage_update_delivered. It returns the json of the parent
+-- node, the number of sessions of the subtree and the update, as a list of node
+-- id and flat list of usage pairs.
+redis.register_function('resources_usage_update_to_parent', function(keys, args)
+    -- Check that the keys of the current node are declared.
+    assert_declared_keys(keys, node_usage_keys, infrastructure_keys,
+        { resources_usage_sent, resources_usage_pending, resources_usage_full_update_at })
+    -- Get the current time in milliseconds.
+    local time = redis.call('TIME')
+    local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+    -- Get the current node and its parent.
+    local current_node = assert_current_node_id()
+    local parent = parent_node(current_node)
+
+    -- If the current node has no parent, return an error.
+    if not parent then
+        return error_reply(error_codes.NODE_NOT_FOUND, 'node ' .. current_node .. ' has no parent')
+    end
+
+    -- Publish the usage of the current node with a new version if it changed.
+    local sessions, usage = current_node_resources_usage()
+    local reported = cjson.decode(redis.call('HGET', infrastructure_usage, current_node) or '{}')
+    local reported_sessions, reported_usage = reported_node_resources_usage(current_node)
+    local changed = reported_sessions ~= sessions or #reported_usage ~= #usage
+    for i = 1, #usage, 2 do
+        changed = changed or reported[usage[i]] ~= usage[i + 1]
+    end
+    if changed then
+        -- The values are kept as strings, so that they are never rounded.
+        local own = flat_to_map(usage)
+        own[usage_sessions_field] = tostring(sessions)
+        own[usage_version_field] = string.format('%d', now)
+        redis.call('HSET', infrastructure_usage, current_node, cjson.encode(own))
+    end
+
+    -- Check if a full update is due.
+    local full = now - (tonumber(redis.call('GET', resources_usage_full_update_at)) or 0) >=
+        resources_usage_full_update_interval
+    if full then
+        redis.call('SET', resources_usage_full_update_at, now)
+    end
+
+    -- Collect the usage of the subtree.
+    local subtree_sessions, update = 0, {}
+    for _, node_id in ipairs(subtree_nodes(current_node)) do
+        local reported_usage = cjson.decode(redis.call('HGET', infrastructure_usage, node_id) or '{}')
+        local version = tonumber(reported_usage[usage_version_field])
+
+        if version then
+            subtree_sessions = subtree_sessions + (tonumber(reported_usage[usage_sessions_field]) or 0)
+
+            -- Include the usage if it changed since the last update.
+            if full or version > (tonumber(redis.call('HGET', resources_usage_sent, node_id)) or 0) then
+                table.insert(update, { node_id, reported_node_resources_usage_flat(node_id) })
+                redis.call('HSET', resources_usage_pending, node_id, string.format('%d', version))
+            end
+        end
+    end
+
+    -- Return the parent node, the number of sessions and the update.
+    return { node_json(parent) or "", subtree_sessions, update }
+end)
+
+-- Function that mark the updates of the resources usage computed by
+-- resources_usage_update_to_parent as sent, once the parent node acknowledged
+-- them. The usage of the updates that are never delivered is included again in
+-- the following ones. It returns the number of nodes marked as sent.
+redis.register_function('resources_usage_update_delivered', function(keys, args)
+    -- Check that the keys of the sent usage are declared.
+    assert_declared_keys(keys, { resources_usage_sent, resources_usage_pending })
+    -- Count the marked nodes.
+    local marked = 0
+    local pending = redis.call('HGETALL', resources_usage_pending)
+
+    for i = 1, #pending, 2 do
+        local node_id, version = pending[i], tonumber(pending[i + 1])
+
+        -- The sent version never decreases.
+        if version > (tonumber(redis.call('HGET', resources_usage_sent, node_id)) or 0) then
+            redis.call('HSET', resources_usage_sent, node_id, pending[i + 1])
+            marked = marked + 1
+        end
+    end
+
+    redis.call('DEL', resources_usage_pending)
+
+    -- Return the number of marked nodes.
+    return marked
+end)
+
+-- Function that merge the update of the resources usage received from a child
+-- node. Args[1] is the json object that maps each node to its usage, including
+-- the reserved fields. The usage of nodes that are not in the subtree of the
+-- current node, and the usage that is not newer than the known one are
+-- ignored, so that updates can be applied more than once and in any order. It
+-- returns the number of nodes whose usage has been updated.
+redis.register_function('resources_usage_update_from_child', function(keys, args)
+    -- Args.
+    local update = cjson.decode(args[1])
+    -- Check that the keys of the current node and of the infrastructure are declared.
+    assert_declared_keys(keys, { current_node_key }, infrastructure_keys)
+    -- Get the current node.
+    local current_node = assert_current_node_id()
+    -- Count the updated nodes.
+    local updated = 0
+
+    for node_id, usage in pairs(update) do
+        local version = tonumber(usage[usage_version_field])
+
+        -- Check if the usage is valid.
+        if not version or tonumber(usage[usage_sessions_field]) == nil then
+            return error_reply(error_codes.INVALID_ARGUMENT, 'usage of node ' .. node_id .. ' has no version or sessions')
+        end
+
+        -- Apply only the usage of the subtree that is newer than the known one.
+        local known = cjson.decode(redis.call('HGET', infrastructure_usage, node_id) or '{}')
+        if node_id ~= current_node and is_descendant_of(node_id, current_node) and
+            version > (tonumber(known[usage_version_field]) or 0) then
+            -- Replace the usage, resources that are not in use anymore are removed.
+            local replaced = {}
+            for resource, value in pairs(usage) do
+                replaced[resource] = string.format('%.17g', value)
+            end
+            redis.call('HSET', infrastructure_usage, node_id, cjson.encode(replaced))
+            updated = updated + 1
+        end
+    end
+
+    -- Return the number of updated nodes.
+    return updated
+end)
+
+-- Function that return the number of sessions and the resources usage of the
+-- subtree rooted at a node, as far as known by the current node.
+redis.register_function('get_subtree_resources_usage', function(keys, args)
+    -- Args.
+    local node_id = args[1]
+    -- Check that the keys of the node are declared.
+    assert_declared_keys(keys, node_usage_keys, infrastructure_keys)
+    -- Get the current node.
+    local current_node = current_node_id()
+    -- Sum the usage of the nodes.
+    local subtree_sessions, subtree_usage, known = 0, {}, false
+
+    for _, id in ipairs(subtree_nodes(node_id)) do
+        local sessions, usage
+        if id == current_node then
+            sessions, usage = current_node_resources_usage()
+        else
+            sessions, usage = reported_node_resources_usage(id)
+        end
+
+        if sessions then
+            known = true
+            subtree_sessions = subtree_sessions + sessions
+            for i = 1, #usage, 2 do
+                subtree_usage[usage[i]] = (subtree_usage[usage[i]] or 0) + tonumber(usage[i + 1])
+            end
+        end
+    end
+
+    -- No node of the subtree reported its usage.
+    if not known then
+        return error_reply(error_codes.NODE_NOT_FOUND, 'resources usage of node ' .. node_id .. ' is not known')
+    end
+
+    -- Flatten the usage.
+    local flat = {}
+    for resource, value in pairs(subtree_usage) do
+        table.insert(flat, resource)
+        table.insert(flat, string.format('%.17g', value))
+    end
+
+    -- Return the number of sessions and the resources usage.
+    return { subtree_sessions, flat }
+end)
+
+-- Function that return the candidate sessions to offload, that are the at most
+-- args[1] most idle sessions that can be offloaded and are not expired. It
+-- returns the current time, the coordinates of the current node (empty if not
+-- known), the resources usage of the current node and the candidates. Each
+-- candidate is a list with the session id, the metadata (client_lat,
+-- client_long, created_in, created_at, updated_at and expires_at) and the flat
+-- list of its resources usage.
+redis.register_function('offload_candidates', function(keys, args)
+    -- Args.
+    local count = tonumber(args[1])
+    -- Check that the keys of the current node are declared.
+    assert_declared_keys(keys, node_usage_keys, sessions_index_keys, { nodes_geoset })
+    -- Get the current time.
+    local time = tonumber(redis.call('TIME')[1])
+
+    -- Check if the count is valid.
+    if count == nil or count < 1 then
+        return error_reply(error_codes.INVALID_ARGUMENT, 'count must be a positive number, got ' .. args[1])
+    end
+
+    -- Get the coordinates of the current node.
+    local current_node = current_node_id()
+    local position = current_node and redis.call('GEOPOS', nodes_geoset, current_node)[1]
+    local coordinates = (position and position[1]) and { position[2], position[1] } or { "", "" }
+    -- Get the resources usage of the current node.
+    local _, usage = current_node_resources_usage()
+
+    -- The sessions are scored by their last update, the most idle come first.
+    local candidates = {}
+    for _, session_id in ipairs(redis.call('ZRANGE', offloadable_sessions_set, 0, count - 1)) do
+        local entry = session_index_entry(session_id)
+        local expires_at = entry and tonumber(entry['expires_at'])
+
+        -- Expired sessions are not worth offloading.
+        if entry and (expires_at == nil or expires_at > time) then
+            local candidate = { session_id }
+            for i, field in ipairs({ 'client_lat', 'client_long', 'created_in', 'created_at', 'updated_at', 'expires_at' }) do
+                candidate[i + 1] = entry[field] or ""
+            end
+            candidate[8] = {}
+            for resource, value in pairs(cjson.decode(redis.call('HGET', sessions_resources, session_id) or '{}')) do
+                table.insert(candidate[8], resource)
+                table.insert(candidate[8], value)
+            end
+            table.insert(candidates, candidate)
+        end
+    end
+
+    -- Return the context and the candidates.
+    return { time, coordinates, usage, candidates }
+end)
+
+-- Half of the circumference of the Earth in km, the maximum distance between
+-- two points on its surface.
+local max_distance_km = 20038
+
+-- Function that return the candidate nodes to offload sessions from a node.
+-- Args are the node id followed by a flat list of session id, client latitude
+-- and client longitude (empty if not known, the node position is used instead). For each session
+-- the candidates are, by tier: the nodes closer to the client than the node
+-- (tier 0), the siblings of the node (tier 1) and its parent (tier 2). It
+-- returns the candidates, as a list of session id, node id, tier and distance
+-- from the client, and the candidate nodes, as a list of node id, node json and
+-- flat list of the last known resources usage of the node.
+redis.register_function('offload_target_candidates', function(keys, args)
+    -- Args.
+    local node_id = args[1]
+    -- Check that the keys of the node are declared.
+    assert_declared_keys(keys, node_usage_keys, infrastructure_keys)
+    -- Get the position of the node.
+    local position = redis.call('GEOPOS', nodes_geoset, node_id)[1]
+
+    -- If node does not exist, return an error.
+    if not position or not position[1] then
+        return error_reply(error_codes.NODE_NOT_FOUND, 'node ' .. node_id .. ' does not exist')
+    end
+
+    -- Get the siblings and the parent of the node.
+    local parent = parent_node(node_id)
+    local tiers = {}
+    if parent then
+        for _, sibling in ipairs(children_nodes(parent)) do
+            tiers[sibling] = 1
+        end
+        tiers[parent] = 2
+    end
+    tiers[node_id] = nil
+
+    local candidates, nodes = {}, {}
+    for i = 2, #args, 3 do
+        local session_id, client_lat, client_long = args[i], args[i + 1], args[i + 2]
+        if client_lat == "" or client_long == "" then
+            client_long, client_lat = position[1], position[2]
+        end
+
+        -- Get the distance of all the nodes from the client.
+        local distances = {}
+        for _, node in ipairs(redis.call('GEOSEARCH', nodes_geoset, 'FROMLONLAT', client_long, client_lat,
+            'BYRADIUS', max_distance_km, 'KM', 'ASC', 'WITHDIST')) do
+            distances[node[1]] = tonumber(node[2])
+        end
+
+        for candidate, distance in pairs(distances) do
+            -- Nodes closer to the client than the node come first.
+            local tier = distance < distances[node_id] and 0 or tiers[candidate]
+
+            if candidate ~= node_id and tier then
+                table.insert(candidates, { session_id, candidate, tier, tostring(distance) })
+                nodes[candidate] = true
+            end
+        end
+    end
+
+    -- Get the candidate nodes and their resources usage.
+    local current_node = current_node_id()
+    local candidate_nodes = {}
+    for candidate, _ in pairs(nodes) do
+        local sessions, usage
+        if candidate == current_node then
+            sessions, usage = current_node_resources_usage()
+        else
+            sessions, usage = reported_node_resources_usage(candidate)
+        end
+        table.insert(candidate_nodes, { candidate, node_json(candidate) or "", usage or {} })
+    end
+
+    -- Return the candidates and the candidate nodes.
+    return { candidates, candidate_nodes }
+end)
+
+-- Return the ids of the ancestors of a node, from the node itself to the root.
+local function ancestor_nodes(node_id)
+    local ancestors, visited = {}, {}
+
+    -- Stop on cycles.
+    while node_id and not visited[node_id] do
+        visited[node_id] = true
+        table.insert(ancestors, node_id)
+        node_id = parent_node(node_id)
+    end
+
+    return ancestors
+end
+
+-- Return the id of the node closest to the client of a session. If the client
+-- location is not set, it is approximated with the node where the session has
+-- been created, or the current node if unknown. The location is the one synced
+-- in the index of the node.
+local function closest_node_to_client(session_id)
+    -- Retrieve client location and created_in node.
+    local entry = session_index_entry(session_id)
+
+    -- If session does not exist, raise an error.
+    if not entry then
+        raise(error_codes.NOT_FOUND, 'session ' .. session_id .. ' does not exist')
+    end
+
+    local client_lat, client_long, created_in = entry['client_lat'] or "", entry['client_long'] or "",
+        entry['created_in'] or ""
+
+    -- If client location is not set, approximate it with a node.
+    if client_lat == "" or client_long == "" then
+        if node_json(created_in) then
+            return created_in
+        end
+
+        return assert_current_node_id()
+    end
+
+    -- Get the closest node.
+    local closest = redis.call('GEOSEARCH', nodes_geoset, 'FROMLONLAT', client_long, client_lat,
+        'BYRADIUS', max_distance_km, 'KM', 'ASC', 'COUNT', 1)
+
+    if #closest == 0 then
+        raise(error_codes.NODE_NOT_FOUND, 'no node found near the client of session ' .. session_id)
+    end
+
+    return closest[1]
+end
+
+-- Function that return the json of the lookup node of a set of sessions, given
+-- as args. It is the lowest common ancestor of the nodes closest to the clients
+-- of the sessions that has children, so that it can plan the offload of all of
+-- them.
+redis.register_function('find_lookup_node', function(keys, args)
+    -- Check that the keys of the index and of the infrastructure are declared.
+    assert_declared_keys(keys, { current_node_key }, sessions_index_keys, infrastructure_keys)
+
+    -- Intersect the ancestors of the node closest to each client, the order of
+    -- the first list is kept so that the first common ancestor is the lowest.
+    local common = ancestor_nodes(closest_node_to_client(args[1]))
+    for i = 2, #args do
+        local ancestors = {}
+        for _, ancestor in ipairs(ancestor_nodes(closest_node_to_client(args[i]))) do
+            ancestors[ancestor] = true
+        end
+
+        local intersection = {}
+        for _, ancestor in ipairs(common) do
+            if ancestors[ancestor] then
+                table.insert(intersection, ancestor)
+            end
+        end
+        common = intersection
+    end
+
+    -- Return the lowest common ancestor with children.
+    for _, node_id in ipairs(common) do
+        if #children_nodes(node_id) > 0 then
+            return node_json(node_id)
+        end
+    end
+
+    return error_reply(error_codes.NODE_NOT_FOUND, 'no common ancestor with children found for the sessions')
+end)
@@ -0,0 +1,107 @@
+package redis_commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ermes-labs/api-go/api"
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	// ErrSessionExpired is returned when a session is expired, it is a
+	// ErrSessionNotFound.
+	ErrSessionExpired = fmt.Errorf("%w: session expired", api.ErrSessionNotFound)
+	// ErrSessionIsOnloading is returned when an action cannot be performed
+	// because a session is onloading.
+	ErrSessionIsOnloading = fmt.Errorf("%w: session is onloading", api.ErrErmes)
+	// ErrSessionIsAcquired is returned when an action cannot be performed
+	// because a session is acquired.
+	ErrSessionIsAcquired = fmt.Errorf("%w: session is acquired", api.ErrErmes)
+	// ErrSessionIsNotOffloaded is returned when an action cannot be performed
+	// because a session is not offloaded.
+	ErrSessionIsNotOffloaded = fmt.Errorf("%w: session is not offloaded", api.ErrErmes)
+	// ErrInvalidSessionState is returned when a session is not in the state
+	// required by an operation.
+	ErrInvalidSessionState = fmt.Errorf("%w: invalid session state", api.ErrErmes)
+	// ErrInvalidArgument is returned when an argument is not valid.
+	ErrInvalidArgument = fmt.Errorf("%w: invalid argument", api.ErrErmes)
+	// ErrInvalidCursor is returned when a cursor is not valid.
+	ErrInvalidCursor = fmt.Errorf("%w: invalid cursor", api.ErrErmes)
+	// ErrNodeNotFound is returned when no node satisfies the request.
+	ErrNodeNotFound = fmt.Errorf("%w: node not found", api.ErrErmes)
+	// ErrNoCurrentNode is returned when the id of the current node is not set.
+	ErrNoCurrentNode = fmt.Errorf("%w: current node not set", api.ErrErmes)
+	// ErrInvalidOffloadData is returned when the offloaded session data cannot
+	// be decoded.
+	ErrInvalidOffloadData = fmt.Errorf("%w: invalid offload data", api.ErrErmes)
+	// ErrUnsupportedOffloadCompression is returned when the offloaded session
+	// data is compressed with a compression that the node does not support,
+	// e.g. one added by a newer version of the package.
+	ErrUnsupportedOffloadCompression = fmt.Errorf("%w: unsupported compression", ErrInvalidOffloadData)
+	// ErrIncompatibleLibrary is returned when the installed ermeslib library
+	// is not compatible with the package.
+	ErrIncompatibleLibrary = fmt.Errorf("%w: incompatible library", api.ErrErmes)
+	// ErrIncompatibleOptions is returned when the options of the api package
+	// do not have the fields that the package reads.
+	ErrIncompatibleOptions = fmt.Errorf("%w: incompatible options", api.ErrErmes)
+	// ErrUnexpectedReply is returned when the reply of an ermeslib function
+	// does not have the expected shape.
+	ErrUnexpectedReply = fmt.Errorf("%w: unexpected reply", api.ErrErmes)
+)
+
+// The errors corresponding to the error codes of the ermeslib functions.
+var errorsByCode = map[string]error{
+	"ERMES_NOT_FOUND":        api.ErrSessionNotFound,
+	"ERMES_EXPIRED":          ErrSessionExpired,
+	"ERMES_OFFLOADING":       api.ErrSessionIsOffloading,
+	"ERMES_ONLOADING":        ErrSessionIsOnloading,
+	"ERMES_ACQUIRED":         ErrSessionIsAcquired,
+	"ERMES_OFFLOAD_ACQUIRED": api.ErrUnableToOffloadAcquiredSession,
+	"ERMES_NO_ACQUISITION":   api.ErrNoAcquisitionToRelease,
+	"ERMES_INVALID_STATE":    ErrInvalidSessionState,
+	"ERMES_INVALID_ARGUMENT": ErrInvalidArgument,
+	"ERMES_NOT_OFFLOADED":    ErrSessionIsNotOffloaded,
+	"ERMES_INVALID_CURSOR":   ErrInvalidCursor,
+	"ERMES_NODE_NOT_FOUND":   ErrNodeNotFound,
+	"ERMES_NO_CURRENT_NODE":  ErrNoCurrentNode,
+}
+
+// Calls a function of the ermeslib library. Errors raised by the library are
+// translated to the corresponding sentinel errors, so that they can be checked
+// with errors.Is.
+func (c *RedisCommands) fcall(
+	ctx context.Context,
+	function string,
+	keys []string,
+	args ...interface{},
+) *redis.Cmd {
+	cmd := c.client.FCall(ctx, function, keys, args...)
+
+	if err := cmd.Err(); err != nil {
+		cmd.SetErr(translateError(err))
+	}
+
+	return cmd
+}
+
+// Translates an error replied by a function of the ermeslib library, that has
+// the form "<code> <message>", to the corresponding sentinel error wrapped with
+// the message. Other errors are returned as they are.
+func translateError(err error) error {
+	var redisErr redis.Error
+	if !errors.As(err, &redisErr) || err == redis.Nil {
+		return err
+	}
+
+	// Errors raised from nested functions may be prefixed by the generic code.
+	code, message, _ := strings.Cut(strings.TrimPrefix(redisErr.Error(), "ERR "), " ")
+
+	if sentinel, ok := errorsByCode[code]; ok {
+		return fmt.Errorf("%w: %s", sentinel, message)
+	}
+
+	return err
+}
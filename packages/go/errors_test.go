@@ -0,0 +1,77 @@
+package redis_commands
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/ermes-labs/api-go/api"
+	"github.com/redis/go-redis/v9"
+)
+
+// An error replied by Redis, as returned by the client.
+type testRedisError string
+
+func (err testRedisError) Error() string { return string(err) }
+
+func (testRedisError) RedisError() {}
+
+func TestTranslateError(t *testing.T) {
+	other := errors.New("connection refused")
+
+	tests := []struct {
+		name        string
+		err         error
+		want        []error
+		wantMessage string
+	}{
+		{"not found", testRedisError("ERMES_NOT_FOUND session a does not exist"), []error{api.ErrSessionNotFound}, "session a does not exist"},
+		{"expired", testRedisError("ERMES_EXPIRED session a expired at 1"), []error{ErrSessionExpired, api.ErrSessionNotFound}, "expired at 1"},
+		{"offloading", testRedisError("ERMES_OFFLOADING session a is offloading"), []error{api.ErrSessionIsOffloading}, ""},
+		{"onloading", testRedisError("ERMES_ONLOADING session a is onloading"), []error{ErrSessionIsOnloading, api.ErrErmes}, ""},
+		{"acquired", testRedisError("ERMES_ACQUIRED session a is acquired"), []error{ErrSessionIsAcquired}, ""},
+		{"offload acquired", testRedisError("ERMES_OFFLOAD_ACQUIRED session a has non_offloadable_uses"), []error{api.ErrUnableToOffloadAcquiredSession}, ""},
+		{"no acquisition", testRedisError("ERMES_NO_ACQUISITION session a"), []error{api.ErrNoAcquisitionToRelease}, ""},
+		{"invalid state", testRedisError("ERMES_INVALID_STATE session a is DELETING, expected ACTIVE"), []error{ErrInvalidSessionState}, "expected ACTIVE"},
+		{"invalid argument", testRedisError("ERMES_INVALID_ARGUMENT id cannot be empty"), []error{ErrInvalidArgument}, ""},
+		{"not offloaded", testRedisError("ERMES_NOT_OFFLOADED session a"), []error{ErrSessionIsNotOffloaded}, ""},
+		{"invalid cursor", testRedisError("ERMES_INVALID_CURSOR cursor must be a SCAN cursor"), []error{ErrInvalidCursor}, ""},
+		{"node not found", testRedisError("ERMES_NODE_NOT_FOUND node b"), []error{ErrNodeNotFound}, ""},
+		{"no current node", testRedisError("ERMES_NO_CURRENT_NODE current node not set"), []error{ErrNoCurrentNode}, ""},
+		{"nested function", testRedisError("ERR ERMES_NOT_FOUND session a does not exist"), []error{api.ErrSessionNotFound}, "session a does not exist"},
+		{"unknown code", testRedisError("ERMES_UNKNOWN message"), nil, ""},
+		{"redis error", testRedisError("WRONGTYPE Operation against a key holding the wrong kind of value"), nil, ""},
+		{"nil", redis.Nil, []error{redis.Nil}, ""},
+		{"other error", other, []error{other}, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := translateError(test.err)
+
+			for _, want := range test.want {
+				if !errors.Is(err, want) {
+					t.Fatalf("translateError() = %v, want an error that is %v", err, want)
+				}
+			}
+
+			// Errors without a code are returned as they are.
+			if test.want == nil && err != test.err {
+				t.Fatalf("translateError() = %v, want %v", err, test.err)
+			}
+
+			if !strings.Contains(err.Error(), test.wantMessage) {
+				t.Fatalf("translateError() = %v, want the message %q", err, test.wantMessage)
+			}
+		})
+	}
+}
+
+func TestErrorsByCode(t *testing.T) {
+	// Every error of the library is an error of Ermes.
+	for code, err := range errorsByCode {
+		if !errors.Is(err, api.ErrErmes) {
+			t.Errorf("errorsByCode[%q] = %v, want an error that is %v", code, err, api.ErrErmes)
+		}
+	}
+}
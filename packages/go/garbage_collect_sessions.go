@@ -2,10 +2,30 @@ package redis_commands
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
 
 	"github.com/ermes-labs/api-go/api"
 )
 
+// The maximum number of calls to the library run by a single garbage
+// collection call, and the maximum number of sessions marked for deletion by
+// each of them.
+const (
+	garbageCollectSteps    = 100
+	garbageCollectSessions = 10
+)
+
+// Statistics about the data removed by a garbage collection call.
+type GarbageCollectStats struct {
+	// The number of sessions removed.
+	Sessions int64
+	// The number of session data keys removed.
+	Keys int64
+}
+
 // Garbage collect sessions, the options to define how the sessions are
 // garbage collected. The function accept a cursor to continue the garbage
 // collection from the last cursor, nil to start from the beginning. The
@@ -16,5 +36,114 @@ func (c *RedisCommands) GarbageCollectSessions(
 	opt api.GarbageCollectSessionsOptions,
 	cursor *string,
 ) (*string, error) {
-	return nil, nil
+	next, _, err := c.GarbageCollectSessionsWithStats(ctx, opt, cursor)
+	return next, err
+}
+
+// Garbage collect sessions as GarbageCollectSessions, returning also the number
+// of sessions and keys removed by the call. Each call removes a bounded number
+// of keys, so that the garbage collection never blocks Redis for long. Only
+// active and offloaded sessions are collected, together with the sessions whose
+// deletion has been interrupted. The cursor is "<session_id>:<scan_cursor>"
+// while a session is being deleted, empty otherwise.
+func (c *RedisCommands) GarbageCollectSessionsWithStats(
+	ctx context.Context,
+	opt api.GarbageCollectSessionsOptions,
+	cursor *string,
+) (*string, GarbageCollectStats, error) {
+	olderThan, err := expiredUnreleasedOlderThan(opt)
+
+	if err != nil {
+		return nil, GarbageCollectStats{}, err
+	}
+
+	// Empty if expired but unreleased sessions must not be collected.
+	ttlAfterExpiration := ""
+	if olderThan != nil {
+		ttlAfterExpiration = strconv.FormatInt(*olderThan, 10)
+	}
+
+	// The session being deleted and the cursor of the scan of its data.
+	var sessionId, scanCursor string
+	if cursor != nil && *cursor != "" {
+		var ok bool
+		if sessionId, scanCursor, ok = strings.Cut(*cursor, ":"); !ok || sessionId == "" {
+			return nil, GarbageCollectStats{}, fmt.Errorf("%w: cursor must be \"<session_id>:<scan>\", got %q", ErrInvalidCursor, *cursor)
+		}
+	}
+
+	var stats GarbageCollectStats
+
+	for steps := 0; steps < garbageCollectSteps; steps++ {
+		// If no session is being deleted, mark the next ones.
+		if sessionId == "" {
+			ids, err := c.fcall(ctx, "collectable_sessions", sessionsIndexKeys(), ttlAfterExpiration, garbageCollectSessions).StringSlice()
+
+			if err != nil {
+				return nil, stats, err
+			}
+
+			// If there are no more sessions to delete, the collection is completed.
+			if len(ids) == 0 {
+				return nil, stats, nil
+			}
+
+			// The sessions marked after the first one are deleted next, as
+			// the sessions being deleted are collected first.
+			for _, id := range ids {
+				collected, err := c.collectSession(ctx, id, ttlAfterExpiration)
+
+				if err != nil {
+					return nil, stats, err
+				}
+
+				if collected && sessionId == "" {
+					sessionId, scanCursor = id, "0"
+				}
+			}
+
+			continue
+		}
+
+		// Delete a chunk of the session.
+		next, keys, err := c.deleteSessionChunk(ctx, sessionId, scanCursor)
+
+		if err != nil {
+			return nil, stats, err
+		}
+
+		stats.Keys += keys
+
+		// If the session has been completely deleted, move to the next one.
+		if scanCursor = next; scanCursor == "" {
+			sessionId = ""
+			stats.Sessions++
+		}
+	}
+
+	// The cursor to continue from.
+	next := ""
+	if sessionId != "" {
+		next = sessionId + ":" + scanCursor
+	}
+
+	return &next, stats, nil
+}
+
+// Marks a session returned by collectable_sessions for deletion, if it is still
+// collectable. It returns true if the session is being deleted. A session that
+// does not exist anymore is removed from the index of the node, that has not
+// been synced with its deletion.
+func (c *RedisCommands) collectSession(
+	ctx context.Context,
+	sessionId string,
+	ttlAfterExpiration string,
+) (bool, error) {
+	collected, err := c.fcallSession(ctx, "collect_session", sessionId, sessionKeys(sessionId), sessionId, ttlAfterExpiration).Int64()
+
+	if errors.Is(err, api.ErrSessionNotFound) {
+		return false, c.syncSessionIndex(ctx, sessionId, `{"state":"DELETED"}`)
+	}
+
+	return collected == 1, err
 }
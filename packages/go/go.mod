@@ -6,6 +6,8 @@ require github.com/redis/go-redis/v9 v9.5.1
 
 require github.com/ermes-labs/api-go v0.0.2
 
+require github.com/klauspost/compress v1.18.0
+
 require (
 	github.com/cespare/xxhash/v2 v2.2.0 // indirect
 	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
@@ -2,6 +2,9 @@ package redis_commands
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
 
 	"github.com/ermes-labs/api-go/api"
 	"github.com/ermes-labs/api-go/infrastructure"
@@ -22,13 +25,13 @@ func (c *RedisCommands) LoadInfrastructure(
 			return err
 		}
 
-		if err := c.client.FCall(ctx, "register_node", []string{area.AreaName}, string(nodeJson)).Err(); err != nil {
+		if err := c.fcall(ctx, "register_node", infrastructureKeys(), area.AreaName, string(nodeJson)).Err(); err != nil {
 			return err
 		}
 
 		if area.Areas != nil {
 			for _, subArea := range area.Areas {
-				if err := c.client.FCall(ctx, "register_node_relation", []string{area.AreaName, subArea.AreaName}).Err(); err != nil {
+				if err := c.fcall(ctx, "register_node_relation", infrastructureKeys(), area.AreaName, subArea.AreaName).Err(); err != nil {
 					return err
 				}
 			}
@@ -38,12 +41,28 @@ func (c *RedisCommands) LoadInfrastructure(
 	return nil
 }
 
+// Get a node by id.
+// errors:
+// - ErrNodeNotFound: If the node has not been loaded.
+func (c *RedisCommands) GetNode(
+	ctx context.Context,
+	nodeId string,
+) (*infrastructure.Node, error) {
+	nodeJson, err := c.fcall(ctx, "get_node", infrastructureKeys(), nodeId).Text()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return infrastructure.UnmarshalNode([]byte(nodeJson))
+}
+
 // Get the parent node of a node.
 func (c *RedisCommands) GetParentNodeOf(
 	ctx context.Context,
 	nodeId string,
 ) (*infrastructure.Node, error) {
-	parentJson, err := c.client.FCall(ctx, "get_parent_node_of", []string{nodeId}).Text()
+	parentJson, err := c.fcall(ctx, "get_parent_node_of", infrastructureKeys(), nodeId).Text()
 
 	if err != nil {
 		return &infrastructure.Node{}, err
@@ -67,7 +86,7 @@ func (c *RedisCommands) GetChildrenNodesOf(
 	ctx context.Context,
 	nodeId string,
 ) ([]infrastructure.Node, error) {
-	childrenJson, err := c.client.FCall(ctx, "get_children_nodes_of", []string{nodeId}).StringSlice()
+	childrenJson, err := c.fcall(ctx, "get_children_nodes_of", infrastructureKeys(), nodeId).StringSlice()
 
 	if err != nil {
 		return nil, err
@@ -95,41 +114,246 @@ func (c *RedisCommands) GetSessionResourcesUsage(
 	ctx context.Context,
 	sessionId string,
 ) (resourcesUsage api.ResourcesUsage, err error) {
-	return nil, nil
+	res, err := c.fcall(ctx, "get_session_resources_usage", sessionsIndexKeys(), sessionId).StringSlice()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return parseResourcesUsage(res)
 }
 
-// Get the resources usage of a node.
+// Get the resources usage of a node. The resources usage of the nodes other
+// than the current one is the last one they reported to the current node. The
+// resources usage of the current node is released by the sync of the sessions
+// index after a session is offloaded or deleted, so it may include the usage
+// of the sessions whose sync is still pending (see RepairSessionsIndex).
+// errors:
+// - ErrNodeNotFound: If the resources usage of the node is not known.
 func (c *RedisCommands) GetNodeResourcesUsage(
 	ctx context.Context,
 	nodeId string,
 ) (sessions uint, resourcesUsage api.ResourcesUsage, err error) {
-	return 0, nil, nil
+	res, err := c.fcall(ctx, "get_node_resources_usage", nodeUsageKeys(infrastructureKeys()...), nodeId).Slice()
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return parseSessionsAndResourcesUsage(res)
+}
+
+// Get the resources usage of the subtree of the infrastructure rooted at a
+// node, as far as known by the current node.
+// errors:
+// - ErrNodeNotFound: If the resources usage of the subtree is not known.
+func (c *RedisCommands) GetSubtreeResourcesUsage(
+	ctx context.Context,
+	nodeId string,
+) (sessions uint, resourcesUsage api.ResourcesUsage, err error) {
+	res, err := c.fcall(ctx, "get_subtree_resources_usage",
+		nodeUsageKeys(infrastructureKeys()...), nodeId).Slice()
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return parseSessionsAndResourcesUsage(res)
 }
 
 // Update the resources usage of a session, this will also update the resources
 // usage of the node.
 // errors:
 // - ErrSessionNotFound: If no session with the given id is found.
+// - ErrInvalidSessionState: If the session is offloaded or being deleted.
 func (c *RedisCommands) UpdateSessionResourcesUsage(
 	ctx context.Context,
 	sessionId string,
 	resourcesUsage api.ResourcesUsage,
 ) (err error) {
-	return nil
+	args := make([]interface{}, 0, 1+2*len(resourcesUsage))
+	args = append(args, sessionId)
+	for resource, usage := range resourcesUsage {
+		args = append(args, resource, strconv.FormatFloat(usage, 'f', -1, 64))
+	}
+
+	return c.fcall(ctx, "update_session_resources_usage", sessionsIndexKeys(), args...).Err()
+}
+
+// Parse a flat list of resource and usage pairs.
+func parseResourcesUsage(pairs []string) (api.ResourcesUsage, error) {
+	resourcesUsage := make(api.ResourcesUsage, len(pairs)/2)
+
+	for i := 0; i+1 < len(pairs); i += 2 {
+		usage, err := strconv.ParseFloat(pairs[i+1], 64)
+
+		if err != nil {
+			return nil, err
+		}
+
+		resourcesUsage[pairs[i]] = usage
+	}
+
+	return resourcesUsage, nil
 }
 
-// Get the update to send to the parent node.
+// Reserved keys of the updates of the resources usage exchanged between nodes.
+// They are not node ids, since node ids cannot contain ":", and they map each
+// node of the update to the number of its sessions and to the version of its
+// usage, so that the usage of each node holds only its resources.
+const (
+	ResourcesUsageSessionsKey = "ermes:sessions"
+	ResourcesUsageVersionKey  = "ermes:version"
+)
+
+// Get the update to send to the parent node. The update maps the nodes of the
+// subtree of the current node to their absolute resources usage, plus the
+// reserved keys that map each node to its number of sessions and to the version
+// of its usage. Only the usage that changed since the last delivered update is
+// included, except for periodic full updates that recover lost updates, so
+// ConfirmResourcesUsageUpdateToParent must be called once the parent received
+// the update. The returned number of sessions is the one of the whole subtree.
+// errors:
+// - ErrNodeNotFound: If the current node has no parent.
 func (c *RedisCommands) ResourcesUsageUpdateToParent(
 	ctx context.Context,
 ) (node infrastructure.Node, sessions uint, resourcesUsageNodesMap map[string]api.ResourcesUsage, err error) {
-	return infrastructure.Node{}, 0, nil, nil
+	res, err := c.fcall(ctx, "resources_usage_update_to_parent",
+		nodeUsageKeys(infrastructureKeys(resourcesUsageSentKey, resourcesUsagePendingKey, resourcesUsageFullUpdateAtKey)...)).Slice()
+
+	if err != nil {
+		return infrastructure.Node{}, 0, nil, err
+	}
+
+	parentJson, ok := res[0].(string)
+	subtreeSessions, ok2 := res[1].(int64)
+	entries, ok3 := res[2].([]interface{})
+
+	if !ok || !ok2 || !ok3 {
+		return infrastructure.Node{}, 0, nil, fmt.Errorf("%w: unexpected reply %v", ErrUnexpectedReply, res)
+	}
+
+	parent, err := infrastructure.UnmarshalNode([]byte(parentJson))
+
+	if err != nil {
+		return infrastructure.Node{}, 0, nil, err
+	}
+
+	resourcesUsageNodesMap = map[string]api.ResourcesUsage{
+		ResourcesUsageSessionsKey: {},
+		ResourcesUsageVersionKey:  {},
+	}
+
+	for _, entry := range entries {
+		entry, ok := entry.([]interface{})
+
+		if !ok || len(entry) != 2 {
+			return infrastructure.Node{}, 0, nil, fmt.Errorf("%w: unexpected entry %v", ErrUnexpectedReply, entry)
+		}
+
+		nodeId, ok := entry[0].(string)
+		pairs, ok2 := entry[1].([]interface{})
+
+		if !ok || !ok2 {
+			return infrastructure.Node{}, 0, nil, fmt.Errorf("%w: unexpected entry %v", ErrUnexpectedReply, entry)
+		}
+
+		usage, err := parseResourcesUsage(toStringSlice(pairs))
+
+		if err != nil {
+			return infrastructure.Node{}, 0, nil, err
+		}
+
+		// Move the reserved fields out of the usage of the node.
+		for _, key := range []string{ResourcesUsageSessionsKey, ResourcesUsageVersionKey} {
+			resourcesUsageNodesMap[key][nodeId] = usage[key]
+			delete(usage, key)
+		}
+
+		resourcesUsageNodesMap[nodeId] = usage
+	}
+
+	return *parent, uint(subtreeSessions), resourcesUsageNodesMap, nil
 }
 
-// Get the update from the child nodes.
+// Confirm that the parent node received the last update returned by
+// ResourcesUsageUpdateToParent, so that the usage it included is not sent
+// again until it changes. The usage of the updates that are not confirmed is
+// included again in the following ones.
+func (c *RedisCommands) ConfirmResourcesUsageUpdateToParent(ctx context.Context) error {
+	return c.fcall(ctx, "resources_usage_update_delivered", []string{resourcesUsageSentKey, resourcesUsagePendingKey}).Err()
+}
+
+// Get the update from the child nodes. The usage of each node replaces the
+// known one only if its version is newer, so updates that are stale or received
+// more than once are ignored. The number of sessions of the subtree is derived
+// from the number of sessions of its nodes in the update, so the total number
+// of sessions is not needed.
+// errors:
+// - ErrInvalidArgument: If a node of the update misses its number of sessions or its version.
 func (c *RedisCommands) ResourcesUsageUpdateFromChild(
 	ctx context.Context,
-	sessions uint,
+	_ uint,
 	resourcesUsageNodesMap map[string]api.ResourcesUsage,
 ) (err error) {
-	return nil
+	sessions := resourcesUsageNodesMap[ResourcesUsageSessionsKey]
+	versions := resourcesUsageNodesMap[ResourcesUsageVersionKey]
+
+	// The usage of each node, with the reserved fields that ermeslib expects.
+	update := make(map[string]map[string]float64, len(resourcesUsageNodesMap))
+	for nodeId, usage := range resourcesUsageNodesMap {
+		if nodeId == ResourcesUsageSessionsKey || nodeId == ResourcesUsageVersionKey {
+			continue
+		}
+
+		nodeUsage := make(map[string]float64, len(usage)+2)
+		for resource, value := range usage {
+			nodeUsage[resource] = value
+		}
+
+		if value, ok := sessions[nodeId]; ok {
+			nodeUsage[ResourcesUsageSessionsKey] = value
+		}
+
+		if value, ok := versions[nodeId]; ok {
+			nodeUsage[ResourcesUsageVersionKey] = value
+		}
+
+		update[nodeId] = nodeUsage
+	}
+
+	if len(update) == 0 {
+		return nil
+	}
+
+	updateJson, err := json.Marshal(update)
+
+	if err != nil {
+		return err
+	}
+
+	return c.fcall(ctx, "resources_usage_update_from_child", infrastructureKeys(currentNodeKey), string(updateJson)).Err()
+}
+
+// Parse the number of sessions and the flat list of resource and usage pairs
+// replied by ermeslib.
+func parseSessionsAndResourcesUsage(res []interface{}) (uint, api.ResourcesUsage, error) {
+	resourcesUsage, err := parseResourcesUsage(toStringSlice(res[1]))
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return uint(res[0].(int64)), resourcesUsage, nil
+}
+
+// Convert a list replied by redis to a slice of strings.
+func toStringSlice(list interface{}) []string {
+	values := make([]string, 0, len(list.([]interface{})))
+
+	for _, value := range list.([]interface{}) {
+		values = append(values, value.(string))
+	}
+
+	return values
 }
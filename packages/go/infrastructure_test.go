@@ -0,0 +1,151 @@
+package redis_commands
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/ermes-labs/api-go/api"
+	"github.com/ermes-labs/api-go/infrastructure"
+)
+
+// An infrastructure with the current node of the tests as the only child of
+// the root.
+const testInfrastructureJson = `{"areaIdentifiers":["region","zone"],"areas":[
+	{"areaName":"root","host":"root.test","geoCoordinates":{"latitude":45,"longitude":9},"resources":{"cpu":8},"areas":[
+		{"areaName":"` + testNodeId + `","host":"node.test","geoCoordinates":{"latitude":45.1,"longitude":9.1},"resources":{"cpu":4}}]}]}`
+
+// Loads the infrastructure of the tests.
+func loadTestInfrastructure(t *testing.T, commands *RedisCommands) {
+	t.Helper()
+	loadTestInfrastructureJson(t, commands, testInfrastructureJson)
+}
+
+// Loads the infrastructure with the given json.
+func loadTestInfrastructureJson(t *testing.T, commands *RedisCommands, infrastructureJson string) {
+	t.Helper()
+
+	infra, _, err := infrastructure.UnmarshalInfrastructure([]byte(infrastructureJson))
+
+	if err != nil {
+		t.Fatalf("UnmarshalInfrastructure() error = %v", err)
+	}
+
+	if err := commands.LoadInfrastructure(context.Background(), *infra); err != nil {
+		t.Fatalf("LoadInfrastructure() error = %v", err)
+	}
+}
+
+func TestSessionResourcesUsageRelease(t *testing.T) {
+	ctx := context.Background()
+	commands, _ := newTestRedisCommands(t)
+
+	sessionId, err := commands.CreateSession(ctx, api.DefaultCreateSessionOptions())
+
+	if err != nil {
+		t.Fatalf("CreateSession() error = %v", err)
+	}
+
+	if err := commands.UpdateSessionResourcesUsage(ctx, sessionId, api.ResourcesUsage{"cpu": 2}); err != nil {
+		t.Fatalf("UpdateSessionResourcesUsage() error = %v", err)
+	}
+
+	if _, usage, err := commands.GetNodeResourcesUsage(ctx, testNodeId); err != nil || !reflect.DeepEqual(usage, api.ResourcesUsage{"cpu": 2}) {
+		t.Fatalf("GetNodeResourcesUsage() = %v, %v, want the usage of the session", usage, err)
+	}
+
+	// The usage is released by the sync of the deleted session.
+	if err := commands.DeleteSession(ctx, sessionId); err != nil {
+		t.Fatalf("DeleteSession() error = %v", err)
+	}
+
+	if _, usage, err := commands.GetNodeResourcesUsage(ctx, testNodeId); err != nil || len(usage) != 0 {
+		t.Fatalf("GetNodeResourcesUsage() after the deletion = %v, %v, want no usage", usage, err)
+	}
+}
+
+func TestResourcesUsageUpdate(t *testing.T) {
+	ctx := context.Background()
+	commands, client := newTestRedisCommands(t)
+	loadTestInfrastructure(t, commands)
+
+	sessionId, err := commands.CreateSession(ctx, api.DefaultCreateSessionOptions())
+
+	if err != nil {
+		t.Fatalf("CreateSession() error = %v", err)
+	}
+
+	if err := commands.UpdateSessionResourcesUsage(ctx, sessionId, api.ResourcesUsage{"cpu": 2}); err != nil {
+		t.Fatalf("UpdateSessionResourcesUsage() error = %v", err)
+	}
+
+	parent, sessions, update, err := commands.ResourcesUsageUpdateToParent(ctx)
+
+	if err != nil {
+		t.Fatalf("ResourcesUsageUpdateToParent() error = %v", err)
+	}
+
+	if parent.AreaName != "root" || sessions != 1 {
+		t.Fatalf("ResourcesUsageUpdateToParent() = %q, %d, want %q, 1", parent.AreaName, sessions, "root")
+	}
+
+	// The usage of the node holds only its resources.
+	if !reflect.DeepEqual(update[testNodeId], api.ResourcesUsage{"cpu": 2}) {
+		t.Fatalf("usage of the node in the update = %v, want %v", update[testNodeId], api.ResourcesUsage{"cpu": 2})
+	}
+
+	if update[ResourcesUsageSessionsKey][testNodeId] != 1 || update[ResourcesUsageVersionKey][testNodeId] <= 0 {
+		t.Fatalf("reserved keys of the update = %v, %v, want the sessions and the version of the node",
+			update[ResourcesUsageSessionsKey], update[ResourcesUsageVersionKey])
+	}
+
+	// The usage is sent again until the update is confirmed.
+	if _, _, again, err := commands.ResourcesUsageUpdateToParent(ctx); err != nil || again[testNodeId] == nil {
+		t.Fatalf("ResourcesUsageUpdateToParent() before the confirmation = %v, %v, want the usage of the node", again, err)
+	}
+
+	if err := commands.ConfirmResourcesUsageUpdateToParent(ctx); err != nil {
+		t.Fatalf("ConfirmResourcesUsageUpdateToParent() error = %v", err)
+	}
+
+	if _, _, delta, err := commands.ResourcesUsageUpdateToParent(ctx); err != nil || delta[testNodeId] != nil {
+		t.Fatalf("ResourcesUsageUpdateToParent() after the confirmation = %v, %v, want no usage", delta, err)
+	}
+
+	// The same database acts as the parent, that knows nothing of the child.
+	client.Del(ctx, infrastructureUsageKey)
+
+	if err := commands.SetCurrentNode(ctx, "root"); err != nil {
+		t.Fatalf("SetCurrentNode() error = %v", err)
+	}
+
+	// Updates received more than once are applied once.
+	for i := 0; i < 2; i++ {
+		if err := commands.ResourcesUsageUpdateFromChild(ctx, sessions, update); err != nil {
+			t.Fatalf("ResourcesUsageUpdateFromChild() error = %v", err)
+		}
+	}
+
+	// Stale updates are ignored.
+	stale := map[string]api.ResourcesUsage{
+		testNodeId:                {"cpu": 3},
+		ResourcesUsageSessionsKey: {testNodeId: 2},
+		ResourcesUsageVersionKey:  {testNodeId: update[ResourcesUsageVersionKey][testNodeId] - 1},
+	}
+
+	if err := commands.ResourcesUsageUpdateFromChild(ctx, 2, stale); err != nil {
+		t.Fatalf("ResourcesUsageUpdateFromChild() of a stale update error = %v", err)
+	}
+
+	childSessions, usage, err := commands.GetNodeResourcesUsage(ctx, testNodeId)
+
+	if err != nil || childSessions != 1 || !reflect.DeepEqual(usage, api.ResourcesUsage{"cpu": 2}) {
+		t.Fatalf("GetNodeResourcesUsage() of the child = %d, %v, %v, want 1, %v", childSessions, usage, err, api.ResourcesUsage{"cpu": 2})
+	}
+
+	// The reserved keys are required.
+	if err := commands.ResourcesUsageUpdateFromChild(ctx, 1, map[string]api.ResourcesUsage{testNodeId: {"cpu": 1}}); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("ResourcesUsageUpdateFromChild() without the reserved keys error = %v, want %v", err, ErrInvalidArgument)
+	}
+}
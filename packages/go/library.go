@@ -0,0 +1,88 @@
+package redis_commands
+
+import (
+	"context"
+	_ "embed"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// The source of the ermeslib library.
+//
+//go:embed ermeslib.lua
+var librarySource string
+
+// The name of the library, as registered by FUNCTION LOAD.
+const libraryName = "ermeslib"
+
+// Matches the version marker of the library source.
+var libraryVersionRegexp = regexp.MustCompile(`(?m)^local library_version = (\d+)$`)
+
+// EnsureLibrary loads the ermeslib library embedded in the package, replacing
+// the installed one if it is older. In a Redis Cluster the library is ensured on
+// every master.
+// errors:
+// - ErrIncompatibleLibrary: If the installed library is newer than the embedded one.
+func (c *RedisCommands) EnsureLibrary(ctx context.Context) error {
+	if cluster, ok := c.client.(*redis.ClusterClient); ok {
+		return cluster.ForEachMaster(ctx, func(ctx context.Context, client *redis.Client) error {
+			return ensureLibrary(ctx, client)
+		})
+	}
+
+	return ensureLibrary(ctx, c.client)
+}
+
+// Ensures the library on a single server.
+func ensureLibrary(ctx context.Context, client redis.Cmdable) error {
+	libraries, err := client.FunctionList(ctx, redis.FunctionListQuery{
+		LibraryNamePattern: libraryName,
+		WithCode:           true,
+	}).Result()
+
+	if err != nil {
+		return err
+	}
+
+	version := libraryVersion(librarySource)
+
+	for _, library := range libraries {
+		if library.Name != libraryName {
+			continue
+		}
+
+		installed := libraryVersion(library.Code)
+
+		if installed == version {
+			return nil
+		}
+
+		// The functions of a newer library may have a different signature.
+		if installed > version {
+			return fmt.Errorf("%w: installed version %d is newer than %d", ErrIncompatibleLibrary, installed, version)
+		}
+	}
+
+	return client.FunctionLoadReplace(ctx, librarySource).Err()
+}
+
+// Returns the version of the source of the library, 0 if it has no version
+// marker, as the libraries that predate it.
+func libraryVersion(source string) int {
+	match := libraryVersionRegexp.FindStringSubmatch(source)
+
+	if match == nil {
+		return 0
+	}
+
+	version, err := strconv.Atoi(match[1])
+
+	if err != nil {
+		return 0
+	}
+
+	return version
+}
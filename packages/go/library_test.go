@@ -0,0 +1,89 @@
+package redis_commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Returns the source of the library with the given version marker.
+func librarySourceWithVersion(version int) string {
+	return libraryVersionRegexp.ReplaceAllString(librarySource, fmt.Sprintf("local library_version = %d", version))
+}
+
+func TestLibraryVersion(t *testing.T) {
+	if version := libraryVersion(librarySource); version <= 0 {
+		t.Fatalf("libraryVersion() of the embedded library = %d, want a positive version", version)
+	}
+
+	if version := libraryVersion(librarySourceWithVersion(7)); version != 7 {
+		t.Fatalf("libraryVersion() = %d, want 7", version)
+	}
+
+	if version := libraryVersion("#!lua name=ermeslib\n"); version != 0 {
+		t.Fatalf("libraryVersion() of a library without marker = %d, want 0", version)
+	}
+}
+
+func TestEnsureLibrary(t *testing.T) {
+	ctx := context.Background()
+	commands, client := newTestRedisCommands(t)
+	version := libraryVersion(librarySource)
+
+	// The library is left as the other tests expect it.
+	t.Cleanup(func() { client.FunctionLoadReplace(ctx, librarySource) })
+
+	// Returns the version of the installed library, -1 if not installed.
+	installedVersion := func() int {
+		libraries, err := client.FunctionList(ctx, redis.FunctionListQuery{LibraryNamePattern: libraryName, WithCode: true}).Result()
+
+		if err != nil {
+			t.Fatalf("FunctionList() error = %v", err)
+		}
+
+		for _, library := range libraries {
+			if library.Name == libraryName {
+				return libraryVersion(library.Code)
+			}
+		}
+
+		return -1
+	}
+
+	tests := []struct {
+		name      string
+		installed string
+		want      int
+		wantErr   error
+	}{
+		{"not installed", "", version, nil},
+		{"older", librarySourceWithVersion(version - 1), version, nil},
+		{"without marker", libraryVersionRegexp.ReplaceAllString(librarySource, ""), version, nil},
+		{"same", librarySource, version, nil},
+		{"newer", librarySourceWithVersion(version + 1), version + 1, ErrIncompatibleLibrary},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client.FunctionDelete(ctx, libraryName)
+
+			if test.installed != "" {
+				if err := client.FunctionLoadReplace(ctx, test.installed).Err(); err != nil {
+					t.Fatalf("FunctionLoadReplace() error = %v", err)
+				}
+			}
+
+			if err := commands.EnsureLibrary(ctx); !errors.Is(err, test.wantErr) {
+				t.Fatalf("EnsureLibrary() error = %v, want %v", err, test.wantErr)
+			}
+
+			// A newer library is left installed.
+			if installed := installedVersion(); installed != test.want {
+				t.Fatalf("installed version = %d, want %d", installed, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package redis_commands
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// The names of the compressions of the stream, as reported in the header.
+var offloadCompressionNames = map[OffloadCompression]string{
+	OffloadCompressionNone: "",
+	OffloadCompressionGzip: "gzip",
+	OffloadCompressionZstd: "zstd",
+}
+
+// Writer that compresses the frames that follow the header of the stream.
+// Flush writes the frames compressed so far, so that each chunk of session data
+// reaches the reader as soon as it is written, while Close completes the
+// compressed stream.
+type offloadStreamCompressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// Returns a compressor that writes in the writer with the given compression.
+func newOffloadStreamCompressor(compression OffloadCompression, writer io.Writer) (offloadStreamCompressor, error) {
+	switch compression {
+	case OffloadCompressionGzip:
+		return gzip.NewWriter(writer), nil
+	case OffloadCompressionZstd:
+		return zstd.NewWriter(writer, zstd.WithEncoderConcurrency(1))
+	case OffloadCompressionNone:
+		return nopCompressor{writer}, nil
+	default:
+		return nil, fmt.Errorf("%w %d", ErrUnsupportedOffloadCompression, compression)
+	}
+}
+
+// Returns a reader that decompresses the reader with the given compression.
+// The returned reader must be closed to release its resources.
+func newOffloadStreamDecompressor(compression OffloadCompression, reader io.Reader) (io.ReadCloser, error) {
+	switch compression {
+	case OffloadCompressionGzip:
+		return gzip.NewReader(reader)
+	case OffloadCompressionZstd:
+		decoder, err := zstd.NewReader(reader, zstd.WithDecoderConcurrency(1))
+
+		if err != nil {
+			return nil, err
+		}
+
+		return decoder.IOReadCloser(), nil
+	case OffloadCompressionNone:
+		return io.NopCloser(reader), nil
+	default:
+		return nil, fmt.Errorf("%w %d", ErrUnsupportedOffloadCompression, compression)
+	}
+}
+
+// Compressor of the streams without compression.
+type nopCompressor struct {
+	io.Writer
+}
+
+// Flush does nothing, the frames are written as they are.
+func (nopCompressor) Flush() error {
+	return nil
+}
+
+// Close does nothing, the writer is closed by the offload.
+func (nopCompressor) Close() error {
+	return nil
+}
@@ -0,0 +1,151 @@
+package redis_commands
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestOffloadStreamCompressionRoundTrip(t *testing.T) {
+	compressions := []OffloadCompression{
+		OffloadCompressionNone,
+		OffloadCompressionGzip,
+		OffloadCompressionZstd,
+	}
+
+	tests := []struct {
+		name   string
+		chunks []string
+	}{
+		{"empty", nil},
+		{"single chunk", []string{"chunk"}},
+		{"many chunks", []string{"first", "", "second", strings.Repeat("third", 1000)}},
+		{"binary", []string{"\x00\xff\x00", "\n\r"}},
+	}
+
+	for _, compression := range compressions {
+		name := offloadCompressionNames[compression]
+		if name == "" {
+			name = "none"
+		}
+
+		for _, test := range tests {
+			t.Run(name+"/"+test.name, func(t *testing.T) {
+				var stream bytes.Buffer
+				compressor, err := newOffloadStreamCompressor(compression, &stream)
+
+				if err != nil {
+					t.Fatalf("newOffloadStreamCompressor() error = %v", err)
+				}
+
+				// Each chunk is flushed, as by the offload.
+				for _, chunk := range test.chunks {
+					if _, err := compressor.Write([]byte(chunk)); err != nil {
+						t.Fatalf("Write() error = %v", err)
+					}
+
+					if err := compressor.Flush(); err != nil {
+						t.Fatalf("Flush() error = %v", err)
+					}
+				}
+
+				if err := compressor.Close(); err != nil {
+					t.Fatalf("Close() error = %v", err)
+				}
+
+				decompressor, err := newOffloadStreamDecompressor(compression, &stream)
+
+				if err != nil {
+					t.Fatalf("newOffloadStreamDecompressor() error = %v", err)
+				}
+
+				defer decompressor.Close()
+
+				data, err := io.ReadAll(decompressor)
+
+				if err != nil {
+					t.Fatalf("ReadAll() error = %v", err)
+				}
+
+				if want := strings.Join(test.chunks, ""); string(data) != want {
+					t.Fatalf("ReadAll() = %d bytes, want %d bytes", len(data), len(want))
+				}
+			})
+		}
+	}
+}
+
+func TestOffloadStreamCompressionFlush(t *testing.T) {
+	for _, compression := range []OffloadCompression{OffloadCompressionGzip, OffloadCompressionZstd} {
+		t.Run(offloadCompressionNames[compression], func(t *testing.T) {
+			var stream bytes.Buffer
+			compressor, err := newOffloadStreamCompressor(compression, &stream)
+
+			if err != nil {
+				t.Fatalf("newOffloadStreamCompressor() error = %v", err)
+			}
+
+			defer compressor.Close()
+
+			if _, err := compressor.Write([]byte("chunk")); err != nil {
+				t.Fatalf("Write() error = %v", err)
+			}
+
+			if err := compressor.Flush(); err != nil {
+				t.Fatalf("Flush() error = %v", err)
+			}
+
+			// A flushed chunk can be read before the stream is closed.
+			decompressor, err := newOffloadStreamDecompressor(compression, bytes.NewReader(stream.Bytes()))
+
+			if err != nil {
+				t.Fatalf("newOffloadStreamDecompressor() error = %v", err)
+			}
+
+			defer decompressor.Close()
+
+			chunk := make([]byte, len("chunk"))
+			if _, err := io.ReadFull(decompressor, chunk); err != nil || string(chunk) != "chunk" {
+				t.Fatalf("ReadFull() = %q, %v, want %q", chunk, err, "chunk")
+			}
+		})
+	}
+}
+
+func TestOffloadStreamDecompressionErrors(t *testing.T) {
+	for _, compression := range []OffloadCompression{OffloadCompressionGzip, OffloadCompressionZstd} {
+		t.Run(offloadCompressionNames[compression], func(t *testing.T) {
+			decompressor, err := newOffloadStreamDecompressor(compression, strings.NewReader("not compressed"))
+
+			// The error is returned either by the decompressor or by the first
+			// read, depending on the compression.
+			if err == nil {
+				defer decompressor.Close()
+				_, err = io.ReadAll(decompressor)
+			}
+
+			if err == nil {
+				t.Fatal("decompression of an uncompressed stream succeeded")
+			}
+		})
+	}
+}
+
+func TestOffloadStreamUnsupportedCompression(t *testing.T) {
+	unsupported := OffloadCompression(len(offloadCompressionNames))
+
+	if _, err := newOffloadStreamCompressor(unsupported, io.Discard); !errors.Is(err, ErrUnsupportedOffloadCompression) {
+		t.Fatalf("newOffloadStreamCompressor() error = %v, want %v", err, ErrUnsupportedOffloadCompression)
+	}
+
+	if _, err := newOffloadStreamDecompressor(unsupported, strings.NewReader("")); !errors.Is(err, ErrUnsupportedOffloadCompression) {
+		t.Fatalf("newOffloadStreamDecompressor() error = %v, want %v", err, ErrUnsupportedOffloadCompression)
+	}
+
+	// The compression of an offload is set only if it is supported.
+	if options := NewOffloadOptionsBuilder().Compression(unsupported).Build(); options.compression != nil {
+		t.Fatalf("Compression() of an unsupported compression = %v, want nil", *options.compression)
+	}
+}
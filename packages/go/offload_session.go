@@ -1,19 +1,31 @@
 package redis_commands
 
 import (
-	"bytes"
 	"context"
+	"errors"
 	"io"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/ermes-labs/api-go/api"
 )
 
+// The session data in the json encoding. Sorted sets map each member to its
+// score and hashes map each field to its value.
 type OffloadData struct {
 	String map[string]string            `json:"string,omitempty"`
 	List   map[string][]string          `json:"list,omitempty"`
 	Set    map[string][]string          `json:"set,omitempty"`
-	ZSet   map[string][]string          `json:"zset,omitempty"`
+	ZSet   map[string]map[string]string `json:"zset,omitempty"`
 	Hash   map[string]map[string]string `json:"hash,omitempty"`
+	// The remaining time to live in milliseconds of the keys that expire.
+	PTTL map[string]int64 `json:"pttl,omitempty"`
+	// The time in milliseconds at which the time to live has been captured, by
+	// the clock of the origin node. The onload subtracts the time elapsed since,
+	// if positive, so a clock skew may shorten the time to live but never
+	// extends it.
+	Time int64 `json:"time,omitempty"`
 }
 
 // OffloadStart starts the offload of a session. The function returns the
@@ -23,36 +35,396 @@ type OffloadData struct {
 // required. The loader function will be run concurrently to the reader process.
 // Errors can flow from the loader function to the reader passing trough the
 // io.Reader, vice-versa the loader should stop if the context is canceled.
+// The offload is canceled if the loader fails, or if the context is canceled
+// or the reader is closed before all the session data has been read. Once the
+// stream has been read, the offload is canceled if it is not confirmed by
+// ConfirmSessionOffload within the confirm timeout of the options (see
+// RedisCommandsOptionsBuilder.OffloadConfirmTimeout). The stream starts with a
+// header that describes the session, followed by the chunks of session data
+// and by a trailer that allows the onloading node to validate it.
 // errors:
 // - ErrSessionNotFound: If no session with the given id is found.
 // - ErrSessionIsOffloading: If the session is already offloading.
 // - ErrUnableToOffloadAcquiredSession: If the session is unable to offload because it is acquired.
+// - ErrSessionExpired: If the session is expired.
 func (c *RedisCommands) OffloadSession(
 	ctx context.Context,
 	id string,
 	opt api.OffloadSessionOptions,
 ) (io.ReadCloser, func(), error) {
-	err := c.client.FCall(ctx, "offload_start", []string{id}).Err()
+	return c.OffloadSessionWithOptions(ctx, id, opt, OffloadOptions{})
+}
 
-	if err != nil {
+// Offload a session as OffloadSession, with the options of the offload that are
+// specific to this store, such as the target size of the chunks of session
+// data.
+func (c *RedisCommands) OffloadSessionWithOptions(
+	ctx context.Context,
+	id string,
+	opt api.OffloadSessionOptions,
+	offloadOpt OffloadOptions,
+) (io.ReadCloser, func(), error) {
+	// The origin of the stream is unknown if the current node is not set.
+	origin, err := c.GetCurrentNode(ctx)
+
+	if err != nil && !errors.Is(err, ErrNoCurrentNode) {
 		return nil, nil, err
 	}
 
-	// TODO: implement cursor and use the loader function for each iteration after the first one.
-	cursor := ""
-	result, err := c.client.FCall(ctx, "offload_data", []string{id}, cursor).StringSlice()
+	compression := c.options.offloadCompression
+	if offloadOpt.compression != nil {
+		compression = *offloadOpt.compression
+	}
+
+	res, err := c.fcallSession(ctx, "offload_start", id, sessionKeys(id), id).StringSlice()
 
 	if err != nil {
 		return nil, nil, err
 	}
 
-	offload_data := []byte(result[1])
-	return io.NopCloser(bytes.NewReader(offload_data)), nil, nil
+	header := offloadStreamHeader{
+		Version:     offloadStreamVersion,
+		Encoding:    offloadEncodingNames[c.options.offloadEncoding],
+		Compression: offloadCompressionNames[compression],
+		Origin:      origin,
+		SessionId:   id,
+	}
+
+	if header.Metadata, err = parseSessionMetadata(res); err != nil {
+		c.CancelSessionOffload(context.WithoutCancel(ctx), id)
+		return nil, nil, err
+	}
+
+	// The loader writes the chunks of session data in the pipe, the reader
+	// receives them as a single stream.
+	reader, writer := io.Pipe()
+
+	// The offload is canceled unless it is confirmed.
+	offload := &pendingOffload{confirmTimeout: offloadOpt.confirmTimeout}
+	if offload.confirmTimeout <= 0 {
+		offload.confirmTimeout = c.options.offloadConfirmTimeout
+	}
+	c.offloads.Store(id, offload)
+
+	// End the offload once the stream is interrupted or read.
+	end := func() {
+		c.endPendingOffload(ctx, id, offload)
+	}
+
+	// The context is watched until the offload ends, is confirmed or canceled.
+	offload.mutex.Lock()
+	offload.stopContext = context.AfterFunc(ctx, end)
+	offload.mutex.Unlock()
+
+	chunkSize := offloadOpt.chunkSize
+	if chunkSize <= 0 {
+		chunkSize = c.options.offloadChunkSize
+	}
+
+	loader := func() {
+		err := c.offloadData(ctx, header, chunkSize, compression, writer)
+
+		if err != nil {
+			c.cancelPendingOffload(ctx, id, offload)
+		} else {
+			offload.complete.Store(true)
+		}
+
+		// Closing with a nil error signals the end of the stream to the reader.
+		writer.CloseWithError(err)
+	}
+
+	return &offloadReader{PipeReader: reader, onClose: end}, loader, nil
+}
+
+// An offload started by OffloadSession, that is canceled unless it is
+// confirmed by ConfirmSessionOffload.
+type pendingOffload struct {
+	// Set once the whole stream has been written.
+	complete atomic.Bool
+	// The time to wait for the confirmation once the stream has been read.
+	confirmTimeout time.Duration
+	// Guards the fields below.
+	mutex sync.Mutex
+	// Set once the stream has been interrupted or read.
+	ended bool
+	// Stops ending the offload once its context is done.
+	stopContext func() bool
+	// Cancels the offload if it is not confirmed in time, nil until the
+	// stream has been read.
+	timer *time.Timer
+}
+
+// Ends a pending offload, once its context is done or its reader is closed. If
+// the stream has not been written completely the offload is canceled,
+// otherwise it is canceled if it is not confirmed within the confirm timeout,
+// e.g. because the onloading node rejected the stream.
+func (c *RedisCommands) endPendingOffload(
+	ctx context.Context,
+	id string,
+	offload *pendingOffload,
+) {
+	offload.mutex.Lock()
+	ended, complete := offload.ended, offload.complete.Load()
+	offload.ended = true
+
+	if offload.stopContext != nil {
+		offload.stopContext()
+	}
+
+	if !ended && complete {
+		offload.timer = time.AfterFunc(offload.confirmTimeout, func() {
+			c.cancelPendingOffload(ctx, id, offload)
+		})
+	}
+
+	offload.mutex.Unlock()
+
+	if !ended && !complete {
+		c.cancelPendingOffload(ctx, id, offload)
+	}
+}
+
+// Cancels a pending offload, unless it has been confirmed, canceled or
+// replaced by another offload of the same session in the meanwhile.
+func (c *RedisCommands) cancelPendingOffload(
+	ctx context.Context,
+	id string,
+	offload *pendingOffload,
+) {
+	if c.offloads.CompareAndDelete(id, offload) {
+		offload.stop()
+		c.fcallSession(context.WithoutCancel(ctx), "offload_cancel", id, sessionKeys(id), id)
+	}
+}
+
+// Stops watching the context and the timer of a pending offload, if any.
+func (offload *pendingOffload) stop() {
+	offload.mutex.Lock()
+	defer offload.mutex.Unlock()
+
+	if offload.stopContext != nil {
+		offload.stopContext()
+	}
+
+	if offload.timer != nil {
+		offload.timer.Stop()
+	}
+}
+
+// Reader of the session data being offloaded, it runs onClose when closed.
+type offloadReader struct {
+	*io.PipeReader
+	onClose func()
+}
+
+// Close closes the reader, see io.PipeReader.Close.
+func (r *offloadReader) Close() error {
+	r.onClose()
+	return r.PipeReader.Close()
+}
+
+// Writes the stream of session data in the writer, that is the header, the
+// chunks of session data of about chunkSize bytes with the configured encoding
+// and the trailer, compressed with the given compression, until all the data
+// has been written or the context is canceled.
+func (c *RedisCommands) offloadData(
+	ctx context.Context,
+	header offloadStreamHeader,
+	chunkSize int64,
+	compression OffloadCompression,
+	writer *io.PipeWriter,
+) error {
+	// Unblock a pending write if the context is canceled.
+	stop := context.AfterFunc(ctx, func() {
+		writer.CloseWithError(ctx.Err())
+	})
+	defer stop()
+
+	offloadChunk := c.offloadJsonChunk
+	if c.options.offloadEncoding == OffloadEncodingDump {
+		offloadChunk = c.offloadDumpChunk
+	}
+
+	buffer, err := appendOffloadStreamJsonFrame([]byte(offloadStreamMagic), offloadStreamHeaderFrame, header)
+
+	if err != nil {
+		return err
+	}
+
+	// The header is written as it is, the frames that follow it are compressed.
+	if _, err := writer.Write(buffer); err != nil {
+		return err
+	}
+
+	compressor, err := newOffloadStreamCompressor(compression, writer)
+
+	if err != nil {
+		return err
+	}
+
+	buffer = buffer[:0]
+
+	var trailer offloadStreamTrailer
+	cursor := newOffloadCursor()
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if err := c.scanOffloadCursor(ctx, header.SessionId, cursor); err != nil {
+			return err
+		}
+
+		payload, keys, err := offloadChunk(ctx, header.SessionId, cursor, chunkSize)
+
+		if err != nil {
+			return err
+		}
+
+		// Chunks without keys are not written.
+		if keys > 0 {
+			buffer = appendOffloadStreamFrame(buffer, offloadStreamDataFrame, payload)
+			trailer.Keys += keys
+			trailer.Checksum = updateOffloadStreamChecksum(trailer.Checksum, payload)
+		}
+
+		// The trailer follows the last chunk.
+		if cursor.done() {
+			if buffer, err = appendOffloadStreamJsonFrame(buffer, offloadStreamTrailerFrame, trailer); err != nil {
+				return err
+			}
+		}
+
+		if len(buffer) > 0 {
+			if _, err := compressor.Write(buffer); err != nil {
+				return err
+			}
+		}
+
+		if cursor.done() {
+			return compressor.Close()
+		}
+
+		if err := compressor.Flush(); err != nil {
+			return err
+		}
+
+		buffer = buffer[:0]
+	}
+}
+
+// The limits of the scan of the session data for a single chunk.
+const (
+	// The maximum number of scans, each one of about sessionDataScanCount
+	// keys, run before a chunk.
+	offloadChunkScans = 10
+	// The maximum number of keys declared to the function that reads a chunk.
+	offloadChunkKeys = 1000
+)
+
+// The position of an offload in the session data.
+type offloadCursor struct {
+	// The cursor of the scan of the keys of the session data, empty once the
+	// scan is completed.
+	scan string
+	// The keys returned by the scan that have not been read completely yet.
+	pending []string
+	// The cursor within the first pending key.
+	sub string
+}
+
+// Returns the cursor of an offload that starts.
+func newOffloadCursor() *offloadCursor {
+	return &offloadCursor{scan: "0", sub: "0"}
+}
+
+// Returns true once all the session data has been read.
+func (cursor *offloadCursor) done() bool {
+	return cursor.scan == "" && len(cursor.pending) == 0
+}
+
+// Scans the keys of the session data until the cursor has enough pending keys
+// for a chunk, at most offloadChunkScans times, so that the scan of a session
+// without the index of its keys, that scans the whole keyspace, is spread over
+// multiple chunks.
+func (c *RedisCommands) scanOffloadCursor(
+	ctx context.Context,
+	id string,
+	cursor *offloadCursor,
+) error {
+	for scans := 0; scans < offloadChunkScans && cursor.scan != "" && len(cursor.pending) < offloadChunkKeys; scans++ {
+		next, keys, err := c.scanSessionData(ctx, id, cursor.scan)
+
+		if err != nil {
+			return err
+		}
+
+		cursor.pending = append(cursor.pending, keys...)
+
+		if cursor.scan = next; cursor.scan == "0" {
+			cursor.scan = ""
+		}
+	}
+
+	return nil
 }
 
-// Confirms the offload of a session.
+// Reads a chunk of session data in the json encoding of about chunkSize bytes
+// from the pending keys of the cursor, that is advanced past the keys that have
+// been read. It returns the payload of the chunk, that is the
+// list of its keys followed by its json, and the number of keys in it.
+func (c *RedisCommands) offloadJsonChunk(
+	ctx context.Context,
+	id string,
+	cursor *offloadCursor,
+	chunkSize int64,
+) ([]byte, int64, error) {
+	if len(cursor.pending) == 0 {
+		return nil, 0, nil
+	}
+
+	keys := cursor.pending[:min(len(cursor.pending), offloadChunkKeys)]
+	result, err := c.fcall(ctx, "offload_data", sessionKeys(id, keys...), id, cursor.sub, chunkSize).Slice()
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	cursor.pending, cursor.sub = cursor.pending[result[0].(int64):], result[1].(string)
+	chunkKeys := toStringSlice(result[3])
+
+	return appendOffloadJsonChunk(nil, chunkKeys, []byte(result[2].(string))), int64(len(chunkKeys)), nil
+}
+
+// Cancels the offload of a session, that becomes active again. It is called
+// automatically by OffloadSession if the stream is interrupted or if the
+// offload is not confirmed in time, but it can be used as soon as the node that
+// should onload the session rejects it.
+// errors:
+// - ErrSessionNotFound: If no session with the given id is found.
+// - ErrInvalidSessionState: If the session is not offloading.
+func (c *RedisCommands) CancelSessionOffload(
+	ctx context.Context,
+	id string,
+) error {
+	if offload, ok := c.offloads.LoadAndDelete(id); ok {
+		offload.(*pendingOffload).stop()
+	}
+
+	return c.fcallSession(ctx, "offload_cancel", id, sessionKeys(id), id).Err()
+}
+
+// Confirms the offload of a session. Once confirmed, the offload started by
+// OffloadSession is not canceled anymore. If the session has been onloaded from
+// another node, that node is notified of the new location through
+// notifyLastVisitedNode, and the offloaded session is deleted if no client has
+// been redirected to this node.
 // errors:
 // - ErrSessionNotFound: If no session with the given id is found.
+// - ErrInvalidSessionState: If the session is not offloading.
+// - ErrNodeNotFound: If the node that offloaded the session has not been loaded.
 func (c *RedisCommands) ConfirmSessionOffload(
 	ctx context.Context,
 	id string,
@@ -61,7 +433,60 @@ func (c *RedisCommands) ConfirmSessionOffload(
 	// TODO: extract into another API?
 	notifyLastVisitedNode func(context.Context, api.SessionLocation) (bool, error),
 ) (err error) {
-	return c.client.FCall(ctx, "offload_finish", []string{id}, newLocation.Host, newLocation.SessionId).Err()
+	res, err := c.fcallSession(ctx, "offload_finish", id, sessionKeys(id), id, newLocation.Host, newLocation.SessionId).StringSlice()
+
+	// If the confirmation fails, the offload is canceled once the confirm
+	// timeout expires.
+	if err != nil {
+		return err
+	}
+
+	if offload, ok := c.offloads.LoadAndDelete(id); ok {
+		offload.(*pendingOffload).stop()
+	}
+
+	// Point the previous location of the session, if it has been onloaded, to
+	// the new one, so that the clients that still know the previous location
+	// skip this node.
+	previousNode, previousSession := res[0], res[1]
+	if previousNode == "" || notifyLastVisitedNode == nil {
+		return nil
+	}
+
+	return c.notifyPreviousLocation(ctx, id, previousNode, previousSession, newLocation, notifyLastVisitedNode)
+}
+
+// Notifies the node that offloaded the session to this node of its new
+// location. If no client has been redirected from that node to this one, no
+// client knows the location of the session on this node, so the offloaded
+// session is deleted.
+func (c *RedisCommands) notifyPreviousLocation(
+	ctx context.Context,
+	id string,
+	previousNode string,
+	previousSession string,
+	newLocation api.SessionLocation,
+	notifyLastVisitedNode func(context.Context, api.SessionLocation) (bool, error),
+) error {
+	node, err := c.GetNode(ctx, previousNode)
+
+	if err != nil {
+		return err
+	}
+
+	clientRedirected, err := notifyLastVisitedNode(ctx, api.NewSessionLocation(node.Host, previousSession))
+
+	if err != nil || clientRedirected {
+		return err
+	}
+
+	// A session that is still acquired is deleted by the garbage collection
+	// once it expires.
+	if err := c.DeleteSession(ctx, id); err != nil && !errors.Is(err, ErrSessionIsAcquired) {
+		return err
+	}
+
+	return nil
 }
 
 // Updates the location of an offloaded session, the function returns true if
@@ -76,7 +501,7 @@ func (c *RedisCommands) UpdateOffloadedSessionLocation(
 	id string,
 	newLocation api.SessionLocation,
 ) (bool, error) {
-	return false, nil
+	return c.fcall(ctx, "update_offloaded_location", sessionKeys(id), id, newLocation.Host, newLocation.SessionId).Bool()
 }
 
 // Returns the offloaded sessions, the function returns the new cursor, the
@@ -90,7 +515,7 @@ func (c *RedisCommands) ScanOffloadedSessions(
 	cursor uint64,
 	count int64,
 ) (ids []string, newCursor uint64, err error) {
-	results, newCursor, err := c.client.ZScan(ctx, "c:offloaded_sessions_set", cursor, "*", count).Result()
+	results, newCursor, err := c.client.ZScan(ctx, offloadedSessionsSetKey, cursor, "*", count).Result()
 	if err != nil {
 		return nil, 0, err
 	}
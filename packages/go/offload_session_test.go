@@ -0,0 +1,293 @@
+package redis_commands
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ermes-labs/api-go/api"
+	"github.com/redis/go-redis/v9"
+)
+
+// Waits until the session is in the given state.
+func waitSessionState(t *testing.T, client redis.UniversalClient, sessionId string, want string) {
+	t.Helper()
+
+	var state string
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if state = client.HGet(context.Background(), sessionMetadataKey(sessionId), "state").Val(); state == want {
+			return
+		}
+	}
+
+	t.Fatalf("state of the session = %q, want %q", state, want)
+}
+
+func TestOffloadSessionConfirmTimeout(t *testing.T) {
+	ctx := context.Background()
+	commands, client := newTestRedisCommands(t)
+
+	expiresAt := time.Now().Add(time.Hour).Unix()
+	sessionId, err := commands.CreateSession(ctx, api.NewCreateSessionOptionsBuilder().UnixExpiresAt(expiresAt).Build())
+
+	if err != nil {
+		t.Fatalf("CreateSession() error = %v", err)
+	}
+
+	// The offload is canceled once the timeout of the offload expires.
+	offloadTestSession(t, commands, sessionId, NewOffloadOptionsBuilder().ConfirmTimeout(10*time.Millisecond).Build())
+	waitSessionState(t, client, sessionId, "ACTIVE")
+
+	// The canceled session expires as before the offload.
+	if got := client.HGet(ctx, sessionMetadataKey(sessionId), "expires_at").Val(); got != strconv.FormatInt(expiresAt, 10) {
+		t.Fatalf("expires_at after the cancel = %q, want %d", got, expiresAt)
+	}
+
+	if score := client.ZScore(ctx, sessionsSetKey, sessionId).Val(); score != float64(expiresAt) {
+		t.Fatalf("score in the sessions set after the cancel = %v, want %d", score, expiresAt)
+	}
+}
+
+func TestConfirmSessionOffloadStopsTimeout(t *testing.T) {
+	ctx := context.Background()
+	commands, client := newTestRedisCommands(t)
+
+	sessionId, err := commands.CreateSession(ctx, api.DefaultCreateSessionOptions())
+
+	if err != nil {
+		t.Fatalf("CreateSession() error = %v", err)
+	}
+
+	offloadTestSession(t, commands, sessionId, NewOffloadOptionsBuilder().ConfirmTimeout(10*time.Millisecond).Build())
+
+	if err := commands.ConfirmSessionOffload(ctx, sessionId, api.NewSessionLocation("host", "session"), api.OffloadSessionOptions{}, nil); err != nil {
+		t.Fatalf("ConfirmSessionOffload() error = %v", err)
+	}
+
+	// A confirmed offload is never canceled.
+	time.Sleep(50 * time.Millisecond)
+	waitSessionState(t, client, sessionId, "OFFLOADED")
+}
+
+func TestOffloadSessionContextCanceled(t *testing.T) {
+	commands, client := newTestRedisCommands(t)
+
+	sessionId, err := commands.CreateSession(context.Background(), api.DefaultCreateSessionOptions())
+
+	if err != nil {
+		t.Fatalf("CreateSession() error = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	reader, loader, err := commands.OffloadSession(ctx, sessionId, api.OffloadSessionOptions{})
+
+	if err != nil {
+		t.Fatalf("OffloadSession() error = %v", err)
+	}
+
+	defer reader.Close()
+
+	// The offload is canceled as soon as the context is done, before the
+	// stream is read.
+	cancel()
+	waitSessionState(t, client, sessionId, "ACTIVE")
+	go loader()
+
+	if _, err := io.ReadAll(reader); err == nil {
+		t.Fatal("ReadAll() of the stream of a canceled offload succeeded")
+	}
+}
+
+func TestOffloadSessionCompression(t *testing.T) {
+	ctx := context.Background()
+	commands, _ := newTestRedisCommands(t)
+
+	sessionId, err := commands.CreateSession(ctx, api.DefaultCreateSessionOptions())
+
+	if err != nil {
+		t.Fatalf("CreateSession() error = %v", err)
+	}
+
+	if err := commands.SessionDataCommand(ctx, sessionId, "SET", "key", "value").Err(); err != nil {
+		t.Fatalf("SessionDataCommand() error = %v", err)
+	}
+
+	// The compression of the offload overrides the one of the commands.
+	stream := offloadTestSession(t, commands, sessionId, NewOffloadOptionsBuilder().Compression(OffloadCompressionGzip).Build())
+	reader := newBytesReader(bytes.TrimPrefix(stream, []byte(offloadStreamMagic)))
+
+	if _, _, compression, err := readOffloadStreamHeader(reader); err != nil || compression != OffloadCompressionGzip {
+		t.Fatalf("readOffloadStreamHeader() compression = %v, %v, want %v", compression, err, OffloadCompressionGzip)
+	}
+
+	metadata, err := commands.GetSessionMetadata(ctx, sessionId)
+
+	if err != nil {
+		t.Fatalf("GetSessionMetadata() error = %v", err)
+	}
+
+	onloadedId, err := commands.OnloadSession(ctx, metadata, bytes.NewReader(stream), api.OnloadSessionOptions{})
+
+	if err != nil {
+		t.Fatalf("OnloadSession() error = %v", err)
+	}
+
+	if value, err := commands.SessionDataCommand(ctx, onloadedId, "GET", "key").Text(); err != nil || value != "value" {
+		t.Fatalf("GET of the onloaded session = %q, %v, want %q", value, err, "value")
+	}
+}
+
+// Returns the payloads of the data frames of an uncompressed offload stream.
+func offloadStreamDataFrames(t *testing.T, stream []byte) [][]byte {
+	t.Helper()
+
+	reader := newBytesReader(bytes.TrimPrefix(stream, []byte(offloadStreamMagic)))
+
+	if _, _, _, err := readOffloadStreamHeader(reader); err != nil {
+		t.Fatalf("readOffloadStreamHeader() error = %v", err)
+	}
+
+	var frames [][]byte
+	for {
+		frameType, payload, err := readOffloadStreamFrame(reader)
+
+		if err != nil {
+			t.Fatalf("readOffloadStreamFrame() error = %v", err)
+		}
+
+		if frameType != offloadStreamDataFrame {
+			return frames
+		}
+
+		frames = append(frames, payload)
+	}
+}
+
+func TestOffloadSessionBigCollections(t *testing.T) {
+	ctx := context.Background()
+	commands, client := newTestRedisCommands(t)
+
+	sessionId, err := commands.CreateSession(ctx, api.DefaultCreateSessionOptions())
+
+	if err != nil {
+		t.Fatalf("CreateSession() error = %v", err)
+	}
+
+	// Collections of many pages of elements.
+	const elements = 1000
+	var values, pairs []interface{}
+	for i := 0; i < elements; i++ {
+		values = append(values, "value-"+strconv.Itoa(i))
+		pairs = append(pairs, i, "value-"+strconv.Itoa(i))
+	}
+
+	for _, command := range []struct {
+		name string
+		key  string
+		args []interface{}
+	}{
+		{"RPUSH", "list", values},
+		{"SADD", "set", values},
+		{"ZADD", "zset", pairs},
+		{"HSET", "hash", pairs},
+	} {
+		if err := commands.SessionDataCommand(ctx, sessionId, command.name, command.key, command.args...).Err(); err != nil {
+			t.Fatalf("SessionDataCommand(%s) error = %v", command.name, err)
+		}
+	}
+
+	want := map[string]int64{"list": elements, "set": elements, "zset": elements, "hash": elements}
+	stream := offloadTestSession(t, commands, sessionId, NewOffloadOptionsBuilder().ChunkSize(1024).Build())
+
+	// Each collection is split over multiple chunks.
+	if frames := offloadStreamDataFrames(t, stream); len(frames) <= len(want) {
+		t.Fatalf("data frames = %d, want the collections split over more chunks", len(frames))
+	}
+
+	metadata, err := commands.GetSessionMetadata(ctx, sessionId)
+
+	if err != nil {
+		t.Fatalf("GetSessionMetadata() error = %v", err)
+	}
+
+	onloadedId, err := commands.OnloadSession(ctx, metadata, bytes.NewReader(stream), api.OnloadSessionOptions{})
+
+	if err != nil {
+		t.Fatalf("OnloadSession() error = %v", err)
+	}
+
+	// The pages of each collection are appended to the same key.
+	got := map[string]int64{
+		"list": client.LLen(ctx, sessionDataKey(onloadedId, "list")).Val(),
+		"set":  client.SCard(ctx, sessionDataKey(onloadedId, "set")).Val(),
+		"zset": client.ZCard(ctx, sessionDataKey(onloadedId, "zset")).Val(),
+		"hash": client.HLen(ctx, sessionDataKey(onloadedId, "hash")).Val(),
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("sizes of the onloaded collections = %v, want %v", got, want)
+	}
+
+	// The order of the list is kept across the pages.
+	if list := client.LRange(ctx, sessionDataKey(onloadedId, "list"), 0, -1).Val(); list[0] != "value-0" || list[elements-1] != "value-999" {
+		t.Fatalf("LRANGE list = [%s ... %s], want [value-0 ... value-999]", list[0], list[elements-1])
+	}
+
+	if score := client.ZScore(ctx, sessionDataKey(onloadedId, "zset"), "value-999").Val(); score != 999 {
+		t.Fatalf("ZSCORE zset value-999 = %v, want 999", score)
+	}
+}
+
+func TestOffloadSessionChunkSize(t *testing.T) {
+	const keys, valueSize = 100, 100
+
+	tests := []struct {
+		name      string
+		chunkSize int64
+		minFrames int
+		maxFrames int
+	}{
+		// Keys are added until the chunk reaches the target size, each one
+		// takes at least the size of its value and less than twice it.
+		{"target size", 1000, keys * valueSize / 1000, 2 * keys * valueSize / 1000},
+		// At least one key is added to each chunk.
+		{"smaller than a key", 1, keys, keys},
+		// The default target size holds the whole session.
+		{"default", 0, 1, 1},
+	}
+
+	for encoding, encodingName := range offloadEncodingNames {
+		for _, test := range tests {
+			t.Run(encodingName+"/"+test.name, func(t *testing.T) {
+				ctx := context.Background()
+				options := NewRedisCommandsOptionsBuilder().OffloadEncoding(encoding).Build()
+				commands, _ := newTestRedisCommandsWithOptions(t, options)
+
+				sessionId, err := commands.CreateSession(ctx, api.DefaultCreateSessionOptions())
+
+				if err != nil {
+					t.Fatalf("CreateSession() error = %v", err)
+				}
+
+				value := strings.Repeat("v", valueSize)
+				for i := 0; i < keys; i++ {
+					if err := commands.SessionDataCommand(ctx, sessionId, "SET", strconv.Itoa(i), value).Err(); err != nil {
+						t.Fatalf("SessionDataCommand() error = %v", err)
+					}
+				}
+
+				stream := offloadTestSession(t, commands, sessionId, NewOffloadOptionsBuilder().ChunkSize(test.chunkSize).Build())
+				frames := offloadStreamDataFrames(t, stream)
+
+				if len(frames) < test.minFrames || len(frames) > test.maxFrames {
+					t.Fatalf("data frames = %d, want between %d and %d", len(frames), test.minFrames, test.maxFrames)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package redis_commands
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"reflect"
+	"strings"
+
+	"github.com/ermes-labs/api-go/api"
+)
+
+// The stream of an offloaded session starts with this marker. It starts with a
+// NUL byte, so it is never mistaken for a bare json stream of older nodes.
+const offloadStreamMagic = "\x00ermes-stream\n"
+
+// The version of the format of the stream, streams with a different version are
+// rejected by the onload.
+const offloadStreamVersion = 1
+
+// The types of the frames of the stream. The stream is composed by a header
+// frame, any number of data frames and a trailer frame. The frames that follow
+// the header are compressed with the compression reported in it.
+const (
+	offloadStreamHeaderFrame  byte = 'H'
+	offloadStreamDataFrame    byte = 'D'
+	offloadStreamTrailerFrame byte = 'T'
+)
+
+// The maximum length of the payload of a frame.
+const maxOffloadStreamFrameLength = 1 << 31
+
+// The names of the encodings of the data frames, as reported in the header.
+var offloadEncodingNames = map[OffloadEncoding]string{
+	OffloadEncodingJson: "json",
+	OffloadEncodingDump: "dump",
+}
+
+// The header of the stream, that describes the offloaded session.
+type offloadStreamHeader struct {
+	// The version of the format of the stream.
+	Version int `json:"version"`
+	// The encoding of the data frames.
+	Encoding string `json:"encoding"`
+	// The compression of the frames that follow the header, empty if they are
+	// not compressed.
+	Compression string `json:"compression,omitempty"`
+	// The id of the node that offloaded the session, empty if unknown.
+	Origin string `json:"origin,omitempty"`
+	// The id of the session on the origin node.
+	SessionId string `json:"session_id"`
+	// The metadata of the session on the origin node.
+	Metadata api.SessionMetadata `json:"metadata"`
+}
+
+// The trailer of the stream, that allows to validate the data frames.
+type offloadStreamTrailer struct {
+	// The number of keys in the data frames, a collection split over multiple
+	// data frames is counted once for each of them.
+	Keys int64 `json:"keys"`
+	// The CRC-32 (IEEE) checksum of the payloads of the data frames.
+	Checksum uint32 `json:"checksum"`
+}
+
+// Appends a frame to the buffer, that is the type of the frame, the length of
+// the payload as a varint and the payload.
+func appendOffloadStreamFrame(buffer []byte, frameType byte, payload []byte) []byte {
+	buffer = append(buffer, frameType)
+	buffer = binary.AppendUvarint(buffer, uint64(len(payload)))
+	return append(buffer, payload...)
+}
+
+// Appends a frame with the json encoding of the value to the buffer.
+func appendOffloadStreamJsonFrame(buffer []byte, frameType byte, value interface{}) ([]byte, error) {
+	payload, err := json.Marshal(value)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return appendOffloadStreamFrame(buffer, frameType, payload), nil
+}
+
+// Reads the next frame of the stream. It returns io.EOF only if the stream ends
+// before the frame.
+func readOffloadStreamFrame(reader *bufio.Reader) (byte, []byte, error) {
+	frameType, err := reader.ReadByte()
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	length, err := binary.ReadUvarint(reader)
+
+	if err != nil {
+		return 0, nil, truncatedOffloadStreamError(err)
+	}
+
+	if length > maxOffloadStreamFrameLength {
+		return 0, nil, fmt.Errorf("%w: frame of %d bytes", ErrInvalidOffloadData, length)
+	}
+
+	// Read through a limited reader, so that a corrupted length does not
+	// allocate the whole frame upfront.
+	payload, err := io.ReadAll(io.LimitReader(reader, int64(length)))
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if uint64(len(payload)) != length {
+		return 0, nil, truncatedOffloadStreamError(io.ErrUnexpectedEOF)
+	}
+
+	return frameType, payload, nil
+}
+
+// Returns the error of a stream that ended before its trailer.
+func truncatedOffloadStreamError(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w: truncated stream", ErrInvalidOffloadData)
+	}
+
+	return err
+}
+
+// Reads the header frame of the stream, that follows the magic, and checks
+// that the stream is supported. It returns the header with its encoding and
+// compression.
+func readOffloadStreamHeader(reader *bufio.Reader) (offloadStreamHeader, OffloadEncoding, OffloadCompression, error) {
+	var header offloadStreamHeader
+	frameType, payload, err := readOffloadStreamFrame(reader)
+
+	if err != nil {
+		return header, 0, 0, truncatedOffloadStreamError(err)
+	}
+
+	if frameType != offloadStreamHeaderFrame {
+		return header, 0, 0, fmt.Errorf("%w: missing header", ErrInvalidOffloadData)
+	}
+
+	if err := json.Unmarshal(payload, &header); err != nil {
+		return header, 0, 0, fmt.Errorf("%w: %w", ErrInvalidOffloadData, err)
+	}
+
+	if header.Version != offloadStreamVersion {
+		return header, 0, 0, fmt.Errorf("%w: unsupported version %d", ErrInvalidOffloadData, header.Version)
+	}
+
+	encoding, ok := offloadStreamOptionByName(offloadEncodingNames, header.Encoding)
+
+	if !ok {
+		return header, 0, 0, fmt.Errorf("%w: unsupported encoding %q", ErrInvalidOffloadData, header.Encoding)
+	}
+
+	compression, ok := offloadStreamOptionByName(offloadCompressionNames, header.Compression)
+
+	if !ok {
+		return header, 0, 0, fmt.Errorf("%w %q", ErrUnsupportedOffloadCompression, header.Compression)
+	}
+
+	return header, encoding, compression, nil
+}
+
+// Checks that the header of the stream describes the session being onloaded,
+// that is the session with the given metadata, and that the location of the
+// session on the origin node is valid.
+func checkOffloadStreamHeader(header offloadStreamHeader, metadata api.SessionMetadata) error {
+	if !reflect.DeepEqual(header.Metadata, metadata) {
+		return fmt.Errorf("%w: metadata of session %s does not match the header", ErrInvalidOffloadData, header.SessionId)
+	}
+
+	if header.SessionId == "" || strings.Contains(header.SessionId, ":") {
+		return fmt.Errorf("%w: invalid session id %q", ErrInvalidOffloadData, header.SessionId)
+	}
+
+	if strings.Contains(header.Origin, ":") {
+		return fmt.Errorf("%w: invalid origin %q", ErrInvalidOffloadData, header.Origin)
+	}
+
+	return nil
+}
+
+// Returns the option with the given name as reported in the header.
+func offloadStreamOptionByName[T comparable](names map[T]string, name string) (T, bool) {
+	for option, optionName := range names {
+		if optionName == name {
+			return option, true
+		}
+	}
+
+	var none T
+	return none, false
+}
+
+// Checks that the trailer of the stream matches the data frames that have been
+// read, and that nothing follows it.
+func checkOffloadStreamTrailer(reader *bufio.Reader, payload []byte, keys int64, checksum uint32) error {
+	var trailer offloadStreamTrailer
+
+	if err := json.Unmarshal(payload, &trailer); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidOffloadData, err)
+	}
+
+	if trailer.Keys != keys {
+		return fmt.Errorf("%w: %d keys received, %d expected", ErrInvalidOffloadData, keys, trailer.Keys)
+	}
+
+	if trailer.Checksum != checksum {
+		return fmt.Errorf("%w: checksum mismatch", ErrInvalidOffloadData)
+	}
+
+	if _, err := reader.ReadByte(); err == nil {
+		return fmt.Errorf("%w: data after the trailer", ErrInvalidOffloadData)
+	} else if err != io.EOF {
+		// A compressed stream may be truncated after the trailer.
+		return truncatedOffloadStreamError(err)
+	}
+
+	return nil
+}
+
+// Appends the payload of a data frame of the json encoding to the buffer, that
+// is the number of keys of the chunk, each key preceded by its length, and the
+// json of the chunk. Integers are encoded as varints. The keys allow to
+// declare them to onload_data without decoding the json.
+func appendOffloadJsonChunk(buffer []byte, keys []string, data []byte) []byte {
+	buffer = binary.AppendUvarint(buffer, uint64(len(keys)))
+	for _, key := range keys {
+		buffer = binary.AppendUvarint(buffer, uint64(len(key)))
+		buffer = append(buffer, key...)
+	}
+
+	return append(buffer, data...)
+}
+
+// Reads the payload of a data frame of the json encoding, as appended by
+// appendOffloadJsonChunk. It returns the keys and the json of the chunk.
+func readOffloadJsonChunk(payload []byte) ([]string, []byte, error) {
+	count, n := binary.Uvarint(payload)
+
+	// Each key takes at least a byte.
+	if n <= 0 || count > uint64(len(payload)-n) {
+		return nil, nil, fmt.Errorf("%w: invalid number of keys", ErrInvalidOffloadData)
+	}
+
+	payload = payload[n:]
+	keys := make([]string, 0, count)
+	for i := uint64(0); i < count; i++ {
+		length, n := binary.Uvarint(payload)
+
+		if n <= 0 || length > uint64(len(payload)-n) {
+			return nil, nil, fmt.Errorf("%w: truncated key", ErrInvalidOffloadData)
+		}
+
+		keys = append(keys, string(payload[n:n+int(length)]))
+		payload = payload[n+int(length):]
+	}
+
+	return keys, payload, nil
+}
+
+// Returns the keys of a chunk of session data in the json encoding, decoding
+// the json, for the chunks that do not carry the list of their keys. The values
+// are not decoded, as older nodes encode some of them differently.
+func offloadDataKeys(chunk []byte) ([]string, error) {
+	var data map[string]json.RawMessage
+
+	if err := json.Unmarshal(chunk, &data); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidOffloadData, err)
+	}
+
+	var keys []string
+	for _, typeName := range []string{"string", "list", "set", "zset", "hash"} {
+		var values map[string]json.RawMessage
+
+		if raw, ok := data[typeName]; ok {
+			if err := json.Unmarshal(raw, &values); err != nil {
+				return nil, fmt.Errorf("%w: %w", ErrInvalidOffloadData, err)
+			}
+		}
+
+		for key := range values {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, nil
+}
+
+// Updates the checksum of the data frames with the payload of a data frame.
+func updateOffloadStreamChecksum(checksum uint32, payload []byte) uint32 {
+	return crc32.Update(checksum, crc32.IEEETable, payload)
+}
@@ -0,0 +1,296 @@
+package redis_commands
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Returns a buffered reader of the bytes.
+func newBytesReader(b []byte) *bufio.Reader {
+	return bufio.NewReader(bytes.NewReader(b))
+}
+
+func TestOffloadStreamFrameRoundTrip(t *testing.T) {
+	tests := []struct {
+		name      string
+		frameType byte
+		payload   []byte
+	}{
+		{"empty", offloadStreamDataFrame, []byte{}},
+		{"short", offloadStreamDataFrame, []byte("chunk")},
+		{"binary", offloadStreamDataFrame, []byte{0, 0xff, '\n', 0}},
+		{"multi-byte length", offloadStreamDataFrame, bytes.Repeat([]byte("x"), 300)},
+		{"trailer", offloadStreamTrailerFrame, []byte(`{"keys":1,"checksum":2}`)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reader := newBytesReader(appendOffloadStreamFrame(nil, test.frameType, test.payload))
+			frameType, payload, err := readOffloadStreamFrame(reader)
+
+			if err != nil {
+				t.Fatalf("readOffloadStreamFrame() error = %v", err)
+			}
+
+			if frameType != test.frameType || !bytes.Equal(payload, test.payload) {
+				t.Fatalf("readOffloadStreamFrame() = %q, %q, want %q, %q", frameType, payload, test.frameType, test.payload)
+			}
+
+			if _, _, err := readOffloadStreamFrame(reader); err != io.EOF {
+				t.Fatalf("readOffloadStreamFrame() at the end error = %v, want io.EOF", err)
+			}
+		})
+	}
+}
+
+func TestReadOffloadStreamFrameErrors(t *testing.T) {
+	frame := appendOffloadStreamFrame(nil, offloadStreamDataFrame, []byte("chunk"))
+
+	tests := []struct {
+		name  string
+		input []byte
+		want  error
+	}{
+		{"empty", nil, io.EOF},
+		{"missing length", frame[:1], ErrInvalidOffloadData},
+		{"truncated payload", frame[:len(frame)-1], ErrInvalidOffloadData},
+		{"oversized length", binary.AppendUvarint([]byte{offloadStreamDataFrame}, maxOffloadStreamFrameLength+1), ErrInvalidOffloadData},
+		{"huge length", binary.AppendUvarint([]byte{offloadStreamDataFrame}, 1<<62), ErrInvalidOffloadData},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, err := readOffloadStreamFrame(newBytesReader(test.input))
+
+			if !errors.Is(err, test.want) {
+				t.Fatalf("readOffloadStreamFrame() error = %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestReadOffloadStreamHeader(t *testing.T) {
+	tests := []struct {
+		name            string
+		header          offloadStreamHeader
+		frameType       byte
+		wantEncoding    OffloadEncoding
+		wantCompression OffloadCompression
+		wantErr         error
+	}{
+		{
+			name:      "json",
+			header:    offloadStreamHeader{Version: offloadStreamVersion, Encoding: "json", SessionId: "a"},
+			frameType: offloadStreamHeaderFrame,
+		},
+		{
+			name:            "dump zstd",
+			header:          offloadStreamHeader{Version: offloadStreamVersion, Encoding: "dump", Compression: "zstd", SessionId: "a"},
+			frameType:       offloadStreamHeaderFrame,
+			wantEncoding:    OffloadEncodingDump,
+			wantCompression: OffloadCompressionZstd,
+		},
+		{
+			name:      "version 0",
+			header:    offloadStreamHeader{Version: 0, Encoding: "json", SessionId: "a"},
+			frameType: offloadStreamHeaderFrame,
+			wantErr:   ErrInvalidOffloadData,
+		},
+		{
+			name:      "newer version",
+			header:    offloadStreamHeader{Version: offloadStreamVersion + 1, Encoding: "json", SessionId: "a"},
+			frameType: offloadStreamHeaderFrame,
+			wantErr:   ErrInvalidOffloadData,
+		},
+		{
+			name:      "unknown encoding",
+			header:    offloadStreamHeader{Version: offloadStreamVersion, Encoding: "xml", SessionId: "a"},
+			frameType: offloadStreamHeaderFrame,
+			wantErr:   ErrInvalidOffloadData,
+		},
+		{
+			name:      "unknown compression",
+			header:    offloadStreamHeader{Version: offloadStreamVersion, Encoding: "json", Compression: "lz4", SessionId: "a"},
+			frameType: offloadStreamHeaderFrame,
+			wantErr:   ErrUnsupportedOffloadCompression,
+		},
+		{
+			name:      "not a header",
+			header:    offloadStreamHeader{Version: offloadStreamVersion, Encoding: "json", SessionId: "a"},
+			frameType: offloadStreamDataFrame,
+			wantErr:   ErrInvalidOffloadData,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			frame, err := appendOffloadStreamJsonFrame(nil, test.frameType, test.header)
+
+			if err != nil {
+				t.Fatalf("appendOffloadStreamJsonFrame() error = %v", err)
+			}
+
+			header, encoding, compression, err := readOffloadStreamHeader(newBytesReader(frame))
+
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("readOffloadStreamHeader() error = %v, want %v", err, test.wantErr)
+			}
+
+			if test.wantErr != nil {
+				return
+			}
+
+			if !reflect.DeepEqual(header, test.header) || encoding != test.wantEncoding || compression != test.wantCompression {
+				t.Fatalf("readOffloadStreamHeader() = %+v, %v, %v, want %+v, %v, %v",
+					header, encoding, compression, test.header, test.wantEncoding, test.wantCompression)
+			}
+		})
+	}
+
+	if _, _, _, err := readOffloadStreamHeader(newBytesReader([]byte{offloadStreamHeaderFrame, 2, '{'})); !errors.Is(err, ErrInvalidOffloadData) {
+		t.Fatalf("readOffloadStreamHeader() of a truncated header error = %v, want %v", err, ErrInvalidOffloadData)
+	}
+}
+
+func TestCheckOffloadStreamTrailer(t *testing.T) {
+	chunks := [][]byte{[]byte("first chunk"), []byte("second chunk")}
+
+	var checksum uint32
+	for _, chunk := range chunks {
+		checksum = updateOffloadStreamChecksum(checksum, chunk)
+	}
+
+	tests := []struct {
+		name    string
+		trailer string
+		keys    int64
+		after   []byte
+		wantErr error
+	}{
+		{"match", "", 2, nil, nil},
+		{"keys mismatch", "", 3, nil, ErrInvalidOffloadData},
+		{"checksum mismatch", `{"keys":2,"checksum":1}`, 2, nil, ErrInvalidOffloadData},
+		{"data after the trailer", "", 2, []byte{0}, ErrInvalidOffloadData},
+		{"invalid json", `{"keys":`, 2, nil, ErrInvalidOffloadData},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			trailer := test.trailer
+			if trailer == "" {
+				frame, err := appendOffloadStreamJsonFrame(nil, offloadStreamTrailerFrame, offloadStreamTrailer{Keys: 2, Checksum: checksum})
+
+				if err != nil {
+					t.Fatalf("appendOffloadStreamJsonFrame() error = %v", err)
+				}
+
+				_, payload, _ := readOffloadStreamFrame(newBytesReader(frame))
+				trailer = string(payload)
+			}
+
+			err := checkOffloadStreamTrailer(newBytesReader(test.after), []byte(trailer), test.keys, checksum)
+
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("checkOffloadStreamTrailer() error = %v, want %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestUpdateOffloadStreamChecksum(t *testing.T) {
+	// The checksum of the chunks does not depend on how the data is split.
+	whole := updateOffloadStreamChecksum(0, []byte("first chunksecond chunk"))
+	split := updateOffloadStreamChecksum(updateOffloadStreamChecksum(0, []byte("first chunk")), []byte("second chunk"))
+
+	if whole != split {
+		t.Fatalf("updateOffloadStreamChecksum() = %d, want %d", split, whole)
+	}
+
+	if reordered := updateOffloadStreamChecksum(updateOffloadStreamChecksum(0, []byte("second chunk")), []byte("first chunk")); reordered == whole {
+		t.Fatalf("updateOffloadStreamChecksum() of reordered chunks = %d, want a different checksum", reordered)
+	}
+}
+
+func TestOffloadJsonChunkRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		keys []string
+		data string
+	}{
+		{"no keys", []string{}, `{}`},
+		{"keys", []string{"a", "b:c", ""}, `{"string":{"a":"1","b:c":"2","":"3"}}`},
+		{"long key", []string{strings.Repeat("k", 200)}, `{"set":{}}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			keys, data, err := readOffloadJsonChunk(appendOffloadJsonChunk(nil, test.keys, []byte(test.data)))
+
+			if err != nil {
+				t.Fatalf("readOffloadJsonChunk() error = %v", err)
+			}
+
+			if !reflect.DeepEqual(keys, test.keys) || string(data) != test.data {
+				t.Fatalf("readOffloadJsonChunk() = %q, %q, want %q, %q", keys, data, test.keys, test.data)
+			}
+		})
+	}
+}
+
+func TestReadOffloadJsonChunkErrors(t *testing.T) {
+	payload := appendOffloadJsonChunk(nil, []string{"key"}, nil)
+
+	tests := []struct {
+		name    string
+		payload []byte
+	}{
+		{"empty", nil},
+		{"too many keys", binary.AppendUvarint(nil, 1<<40)},
+		{"truncated key", payload[:len(payload)-1]},
+		{"missing key", payload[:1]},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, _, err := readOffloadJsonChunk(test.payload); !errors.Is(err, ErrInvalidOffloadData) {
+				t.Fatalf("readOffloadJsonChunk() error = %v, want %v", err, ErrInvalidOffloadData)
+			}
+		})
+	}
+}
+
+func TestOffloadDataKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		chunk   string
+		want    []string
+		wantErr error
+	}{
+		{"empty", `{}`, nil, nil},
+		{"every type", `{"string":{"s":"1"},"list":{"l":["a"]},"set":{"t":["a"]},"zset":{"z":{"a":"1"}},"hash":{"h":{"f":"v"}},"pttl":{"s":10},"time":1}`,
+			[]string{"s", "l", "t", "z", "h"}, nil},
+		{"flat hash of older nodes", `{"hash":{"h":["f","v"]}}`, []string{"h"}, nil},
+		{"invalid json", `{"string":`, nil, ErrInvalidOffloadData},
+		{"invalid type", `{"string":["s"]}`, nil, ErrInvalidOffloadData},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			keys, err := offloadDataKeys([]byte(test.chunk))
+
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("offloadDataKeys() error = %v, want %v", err, test.wantErr)
+			}
+
+			if !reflect.DeepEqual(keys, test.want) {
+				t.Fatalf("offloadDataKeys() = %q, want %q", keys, test.want)
+			}
+		})
+	}
+}
@@ -1,15 +1,24 @@
 package redis_commands
 
 import (
+	"bufio"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"strconv"
 
 	"github.com/ermes-labs/api-go/api"
+	"github.com/google/uuid"
 )
 
 // StartOnload starts the onload of a session and returns the id of the
-// session.
+// session. The reader is consumed as a stream of data chunks, each one applied
+// as soon as it is received. If the onload fails, the partially onloaded
+// session is deleted.
 // errors:
+// - ErrInvalidOffloadData: If the stream is truncated, corrupted, has an unsupported version or does not match the metadata.
 // - ErrSessionNotFound: If no session with the given id is found.
 // - ErrSessionAlreadyOnloaded: If the session is already onloaded.
 func (c *RedisCommands) OnloadSession(
@@ -18,5 +27,249 @@ func (c *RedisCommands) OnloadSession(
 	reader io.Reader,
 	opt api.OnloadSessionOptions,
 ) (string, error) {
-	return "", nil
+	// Create the session in the ONLOADING state.
+	sessionId, err := c.onloadStart(ctx, metadata)
+
+	if err != nil {
+		return "", err
+	}
+
+	// Apply the session data.
+	header, err := c.onloadData(ctx, sessionId, metadata, reader)
+
+	if err == nil {
+		// Set the session as active, recording the location of the session on
+		// the offloading node as its previous location, that is notified once
+		// the session is offloaded again. Bare json streams do not carry it,
+		// nor the streams of nodes without a current node, that cannot be
+		// notified.
+		var previousNode, previousSession string
+		if header != nil && header.Origin != "" && header.SessionId != "" {
+			previousNode, previousSession = header.Origin, header.SessionId
+		}
+
+		err = c.fcallSession(ctx, "onload_finish", sessionId, sessionKeys(sessionId), sessionId, previousNode, previousSession).Err()
+	}
+
+	// If there is an error, delete the partially onloaded session.
+	if err != nil {
+		return "", errors.Join(err, c.onloadRollback(ctx, sessionId))
+	}
+
+	return sessionId, nil
+}
+
+// Creates a new session in the ONLOADING state with the given metadata and
+// returns its id.
+func (c *RedisCommands) onloadStart(
+	ctx context.Context,
+	metadata api.SessionMetadata,
+) (string, error) {
+	latitude, longitude := formatGeoCoordinates(metadata.ClientGeoCoordinates)
+	createdAt := strconv.FormatInt(metadata.CreatedAt, 10)
+	updatedAt := strconv.FormatInt(metadata.UpdatedAt, 10)
+	expiresAt := formatUnixTimestamp(metadata.ExpiresAt)
+
+	for {
+		sessionId := uuid.NewString()
+
+		res, err := c.fcallSession(ctx, "onload_start", sessionId, sessionKeys(sessionId),
+			sessionId,
+			latitude,
+			longitude,
+			metadata.CreatedIn,
+			createdAt,
+			updatedAt,
+			expiresAt,
+			formatFlag(c.options.indexSessionKeys)).Bool()
+
+		if err != nil {
+			return "", err
+		}
+
+		// Retry with another id if the generated one is already in use.
+		if res {
+			return sessionId, nil
+		}
+	}
+}
+
+// Reads the chunks of session data from the reader and applies each one of
+// them to the onloading session. It returns the header of the stream, nil for
+// the bare json streams of older nodes.
+func (c *RedisCommands) onloadData(
+	ctx context.Context,
+	sessionId string,
+	metadata api.SessionMetadata,
+	reader io.Reader,
+) (*offloadStreamHeader, error) {
+	buffered := bufio.NewReader(reader)
+
+	if magic, _ := buffered.Peek(len(offloadStreamMagic)); string(magic) == offloadStreamMagic {
+		buffered.Discard(len(magic))
+		return c.onloadStreamData(ctx, sessionId, metadata, buffered)
+	}
+
+	return nil, c.onloadJsonData(ctx, sessionId, buffered)
+}
+
+// Reads the frames of the stream and applies each chunk of session data to the
+// onloading session. The stream is rejected if it has an unsupported version
+// or encoding, if its header does not describe the session with the given
+// metadata, or if it does not match its trailer. It returns the header of the
+// stream.
+func (c *RedisCommands) onloadStreamData(
+	ctx context.Context,
+	sessionId string,
+	metadata api.SessionMetadata,
+	reader *bufio.Reader,
+) (*offloadStreamHeader, error) {
+	header, encoding, compression, err := readOffloadStreamHeader(reader)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkOffloadStreamHeader(header, metadata); err != nil {
+		return nil, err
+	}
+
+	decompressor, err := newOffloadStreamDecompressor(compression, reader)
+
+	if errors.Is(err, ErrInvalidOffloadData) {
+		return nil, err
+	} else if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidOffloadData, err)
+	}
+
+	defer decompressor.Close()
+
+	// The frames that follow the header are read from the decompressed stream.
+	reader = bufio.NewReader(decompressor)
+
+	onloadChunk := c.onloadJsonChunk
+	if encoding == OffloadEncodingDump {
+		onloadChunk = c.onloadDumpChunk
+	}
+
+	var keys int64
+	var checksum uint32
+
+	for {
+		frameType, payload, err := readOffloadStreamFrame(reader)
+
+		// The stream must end with the trailer.
+		if err != nil {
+			return nil, truncatedOffloadStreamError(err)
+		}
+
+		switch frameType {
+		case offloadStreamDataFrame:
+			checksum = updateOffloadStreamChecksum(checksum, payload)
+			chunkKeys, err := onloadChunk(ctx, sessionId, payload)
+
+			if err != nil {
+				return nil, err
+			}
+
+			keys += chunkKeys
+		case offloadStreamTrailerFrame:
+			return &header, checkOffloadStreamTrailer(reader, payload, keys, checksum)
+		default:
+			return nil, fmt.Errorf("%w: unknown frame type %q", ErrInvalidOffloadData, frameType)
+		}
+	}
+}
+
+// Applies the payload of a data frame in the json encoding, that is the list of
+// the keys of the chunk followed by its json, to the onloading session. It
+// returns the number of keys in the chunk.
+func (c *RedisCommands) onloadJsonChunk(
+	ctx context.Context,
+	sessionId string,
+	payload []byte,
+) (int64, error) {
+	keys, chunk, err := readOffloadJsonChunk(payload)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return c.onloadJsonChunkKeys(ctx, sessionId, keys, chunk)
+}
+
+// Applies a chunk of a bare json stream, that does not carry the list of its
+// keys, to the onloading session.
+func (c *RedisCommands) onloadBareJsonChunk(
+	ctx context.Context,
+	sessionId string,
+	chunk []byte,
+) (int64, error) {
+	keys, err := offloadDataKeys(chunk)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return c.onloadJsonChunkKeys(ctx, sessionId, keys, chunk)
+}
+
+// Applies a chunk of session data in the json encoding with the given keys,
+// that are declared to onload_data, to the onloading session.
+func (c *RedisCommands) onloadJsonChunkKeys(
+	ctx context.Context,
+	sessionId string,
+	keys []string,
+	chunk []byte,
+) (int64, error) {
+	dataKeys := make([]string, 0, len(keys))
+	for _, key := range keys {
+		dataKeys = append(dataKeys, sessionDataKey(sessionId, key))
+	}
+
+	return c.fcall(ctx, "onload_data", sessionKeys(sessionId, dataKeys...), sessionId, string(chunk)).Int64()
+}
+
+// Reads the chunks of session data of a bare json stream and applies each one
+// of them to the onloading session.
+func (c *RedisCommands) onloadJsonData(
+	ctx context.Context,
+	sessionId string,
+	reader io.Reader,
+) error {
+	decoder := json.NewDecoder(reader)
+
+	for {
+		// Read the next chunk, the stream is a sequence of json objects.
+		var chunk json.RawMessage
+		err := decoder.Decode(&chunk)
+
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if _, err := c.onloadBareJsonChunk(ctx, sessionId, chunk); err != nil {
+			return err
+		}
+	}
+}
+
+// Deletes a session that failed to onload.
+func (c *RedisCommands) onloadRollback(
+	ctx context.Context,
+	sessionId string,
+) error {
+	// The rollback must run even if the onload failed because the context has
+	// been canceled.
+	ctx = context.WithoutCancel(ctx)
+
+	if err := c.fcallSession(ctx, "onload_cancel", sessionId, sessionKeys(sessionId), sessionId).Err(); err != nil {
+		return err
+	}
+
+	return c.deleteSessionData(ctx, sessionId)
 }
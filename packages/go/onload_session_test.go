@@ -0,0 +1,247 @@
+package redis_commands
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ermes-labs/api-go/api"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestOnloadSessionWithoutOrigin(t *testing.T) {
+	ctx := context.Background()
+	commands, client := newTestRedisCommands(t)
+
+	sessionId, err := commands.CreateSession(ctx, api.DefaultCreateSessionOptions())
+
+	if err != nil {
+		t.Fatalf("CreateSession() error = %v", err)
+	}
+
+	// The stream of a node without a current node has no origin.
+	client.Del(ctx, currentNodeKey)
+	stream := offloadTestSession(t, commands, sessionId, OffloadOptions{})
+	metadata, err := commands.GetSessionMetadata(ctx, sessionId)
+
+	if err != nil {
+		t.Fatalf("GetSessionMetadata() error = %v", err)
+	}
+
+	client.Set(ctx, currentNodeKey, testNodeId, 0)
+	onloadedId, err := commands.OnloadSession(ctx, metadata, bytes.NewReader(stream), api.OnloadSessionOptions{})
+
+	if err != nil {
+		t.Fatalf("OnloadSession() error = %v", err)
+	}
+
+	location, err := client.HMGet(ctx, sessionMetadataKey(onloadedId), "previous_node", "previous_session").Result()
+
+	if err != nil {
+		t.Fatalf("HMGet() error = %v", err)
+	}
+
+	if location[0] != "" || location[1] != "" {
+		t.Fatalf("previous location = %q, want no previous location", location)
+	}
+}
+
+func TestOnloadSessionDumpTimeToLive(t *testing.T) {
+	ctx := context.Background()
+	options := NewRedisCommandsOptionsBuilder().OffloadEncoding(OffloadEncodingDump).IndexSessionKeys(true).Build()
+	commands, client := newTestRedisCommandsWithOptions(t, options)
+
+	sessionId, err := commands.CreateSession(ctx, api.DefaultCreateSessionOptions())
+
+	if err != nil {
+		t.Fatalf("CreateSession() error = %v", err)
+	}
+
+	commands.SessionDataCommand(ctx, sessionId, "SET", "persistent", "value")
+	commands.SessionDataCommand(ctx, sessionId, "SET", "volatile", "value", "PX", 60000)
+
+	stream := offloadTestSession(t, commands, sessionId, OffloadOptions{})
+	metadata, err := commands.GetSessionMetadata(ctx, sessionId)
+
+	if err != nil {
+		t.Fatalf("GetSessionMetadata() error = %v", err)
+	}
+
+	onloadedId, err := commands.OnloadSession(ctx, metadata, bytes.NewReader(stream), api.OnloadSessionOptions{})
+
+	if err != nil {
+		t.Fatalf("OnloadSession() error = %v", err)
+	}
+
+	// The time to live is relative, so it does not depend on the clocks.
+	if pttl := client.PTTL(ctx, sessionDataKey(onloadedId, "volatile")).Val(); pttl <= 0 || pttl > time.Minute {
+		t.Fatalf("PTTL(volatile) = %v, want at most a minute", pttl)
+	}
+
+	if pttl := client.PTTL(ctx, sessionDataKey(onloadedId, "persistent")).Val(); pttl != -time.Nanosecond {
+		t.Fatalf("PTTL(persistent) = %v, want no expiration", pttl)
+	}
+
+	// The second key of the session is the index of the keys of its data.
+	if keys := client.SCard(ctx, sessionKeys(onloadedId)[1]).Val(); keys != 2 {
+		t.Fatalf("SCard() of the index of the keys = %d, want 2", keys)
+	}
+}
+
+// Writes a key of every type in the session data.
+func writeTestSessionData(t *testing.T, commands *RedisCommands, sessionId string) {
+	t.Helper()
+
+	ctx := context.Background()
+	commands.SessionDataCommand(ctx, sessionId, "SET", "string", "value")
+	commands.SessionDataCommand(ctx, sessionId, "RPUSH", "list", "a", "b", "a")
+	commands.SessionDataCommand(ctx, sessionId, "SADD", "set", "a", "b")
+	commands.SessionDataCommand(ctx, sessionId, "ZADD", "zset", 1, "a", 2.5, "b")
+
+	if err := commands.SessionDataCommand(ctx, sessionId, "HSET", "hash", "field", "value").Err(); err != nil {
+		t.Fatalf("SessionDataCommand() error = %v", err)
+	}
+}
+
+// Checks that the session data is the one written by writeTestSessionData.
+func checkTestSessionData(t *testing.T, client redis.UniversalClient, sessionId string) {
+	t.Helper()
+
+	ctx := context.Background()
+
+	if value := client.Get(ctx, sessionDataKey(sessionId, "string")).Val(); value != "value" {
+		t.Errorf("GET string = %q, want %q", value, "value")
+	}
+
+	if list := client.LRange(ctx, sessionDataKey(sessionId, "list"), 0, -1).Val(); !reflect.DeepEqual(list, []string{"a", "b", "a"}) {
+		t.Errorf("LRANGE list = %q, want [a b a]", list)
+	}
+
+	if set := client.SMembers(ctx, sessionDataKey(sessionId, "set")).Val(); len(set) != 2 {
+		t.Errorf("SMEMBERS set = %q, want [a b]", set)
+	}
+
+	if zset := client.ZRangeWithScores(ctx, sessionDataKey(sessionId, "zset"), 0, -1).Val(); !reflect.DeepEqual(zset, []redis.Z{{Score: 1, Member: "a"}, {Score: 2.5, Member: "b"}}) {
+		t.Errorf("ZRANGE zset = %v, want [{1 a} {2.5 b}]", zset)
+	}
+
+	if hash := client.HGetAll(ctx, sessionDataKey(sessionId, "hash")).Val(); !reflect.DeepEqual(hash, map[string]string{"field": "value"}) {
+		t.Errorf("HGETALL hash = %v, want map[field:value]", hash)
+	}
+}
+
+func TestOnloadSession(t *testing.T) {
+	for encoding, name := range offloadEncodingNames {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			options := NewRedisCommandsOptionsBuilder().OffloadEncoding(encoding).Build()
+			commands, client := newTestRedisCommandsWithOptions(t, options)
+
+			sessionId, err := commands.CreateSession(ctx, api.DefaultCreateSessionOptions())
+
+			if err != nil {
+				t.Fatalf("CreateSession() error = %v", err)
+			}
+
+			writeTestSessionData(t, commands, sessionId)
+			stream := offloadTestSession(t, commands, sessionId, OffloadOptions{})
+			metadata, err := commands.GetSessionMetadata(ctx, sessionId)
+
+			if err != nil {
+				t.Fatalf("GetSessionMetadata() error = %v", err)
+			}
+
+			onloadedId, err := commands.OnloadSession(ctx, metadata, bytes.NewReader(stream), api.OnloadSessionOptions{})
+
+			if err != nil {
+				t.Fatalf("OnloadSession() error = %v", err)
+			}
+
+			waitSessionState(t, client, onloadedId, "ACTIVE")
+			checkTestSessionData(t, client, onloadedId)
+
+			// The location on the offloading node is the previous location.
+			location := client.HMGet(ctx, sessionMetadataKey(onloadedId), "previous_node", "previous_session").Val()
+
+			if location[0] != testNodeId || location[1] != sessionId {
+				t.Fatalf("previous location = %q, want [%s %s]", location, testNodeId, sessionId)
+			}
+		})
+	}
+}
+
+func TestOnloadSessionBareJson(t *testing.T) {
+	ctx := context.Background()
+	commands, client := newTestRedisCommands(t)
+	now := time.Now().Unix()
+	metadata := api.SessionMetadata{CreatedIn: "origin", CreatedAt: now, UpdatedAt: now}
+
+	// The streams of older nodes are a sequence of json chunks.
+	stream := `{"string":{"a":"1"}}{"hash":{"b":{"field":"value"}}}`
+	sessionId, err := commands.OnloadSession(ctx, metadata, strings.NewReader(stream), api.OnloadSessionOptions{})
+
+	if err != nil {
+		t.Fatalf("OnloadSession() error = %v", err)
+	}
+
+	if value := client.Get(ctx, sessionDataKey(sessionId, "a")).Val(); value != "1" {
+		t.Fatalf("GET a = %q, want %q", value, "1")
+	}
+
+	if value := client.HGet(ctx, sessionDataKey(sessionId, "b"), "field").Val(); value != "value" {
+		t.Fatalf("HGET b field = %q, want %q", value, "value")
+	}
+
+	// The stream does not carry the previous location.
+	if location := client.HGet(ctx, sessionMetadataKey(sessionId), "previous_node").Val(); location != "" {
+		t.Fatalf("previous node = %q, want none", location)
+	}
+}
+
+func TestOnloadSessionRollback(t *testing.T) {
+	ctx := context.Background()
+	commands, client := newTestRedisCommands(t)
+
+	sessionId, err := commands.CreateSession(ctx, api.DefaultCreateSessionOptions())
+
+	if err != nil {
+		t.Fatalf("CreateSession() error = %v", err)
+	}
+
+	writeTestSessionData(t, commands, sessionId)
+	stream := offloadTestSession(t, commands, sessionId, OffloadOptions{})
+	metadata, err := commands.GetSessionMetadata(ctx, sessionId)
+
+	if err != nil {
+		t.Fatalf("GetSessionMetadata() error = %v", err)
+	}
+
+	// The stream is truncated before its trailer.
+	_, err = commands.OnloadSession(ctx, metadata, bytes.NewReader(stream[:len(stream)-1]), api.OnloadSessionOptions{})
+
+	if !errors.Is(err, ErrInvalidOffloadData) {
+		t.Fatalf("OnloadSession() error = %v, want %v", err, ErrInvalidOffloadData)
+	}
+
+	// Only the keys of the offloaded session are left.
+	for _, pattern := range []string{"m:*", "s:*"} {
+		for _, key := range client.Keys(ctx, pattern).Val() {
+			if !strings.Contains(key, sessionId) {
+				t.Errorf("key %s of the rolled back session is left", key)
+			}
+		}
+	}
+
+	// The rolled back session is deleted from the sets of the node.
+	if sessions := client.ZRange(ctx, sessionsSetKey, 0, -1).Val(); !reflect.DeepEqual(sessions, []string{sessionId}) {
+		t.Errorf("ZRANGE of the sessions set = %q, want only the offloaded session", sessions)
+	}
+
+	if deleted := client.ZCard(ctx, deletedSessionsSetKey).Val(); deleted != 1 {
+		t.Errorf("ZCARD of the deleted sessions set = %d, want the rolled back session", deleted)
+	}
+}
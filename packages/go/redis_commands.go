@@ -2,6 +2,7 @@ package redis_commands
 
 import (
 	"context"
+	"sync"
 
 	"github.com/ermes-labs/api-go/api"
 	"github.com/redis/go-redis/v9"
@@ -10,16 +11,45 @@ import (
 // RedisCommands is a wrapper around the Redis client.
 type RedisCommands struct {
 	api.Commands
-	client *redis.Client
+	client  redis.UniversalClient
+	options RedisCommandsOptions
+	// The offloads started by OffloadSession that have not been confirmed or
+	// canceled yet, by session id.
+	offloads sync.Map
 }
 
-// NewRedisCommands creates a new RedisCommands instance.
-func NewRedisCommands(client *redis.Client) *RedisCommands {
+// NewRedisCommands creates a new RedisCommands instance. The client can be a
+// single node client as well as a Redis Cluster client, since the functions of
+// the library never touch keys of different slots (see NodeKeysPrefix).
+func NewRedisCommands(client redis.UniversalClient) *RedisCommands {
+	return NewRedisCommandsWithOptions(client, DefaultRedisCommandsOptions())
+}
+
+// NewRedisCommandsWithOptions creates a new RedisCommands instance with the
+// given options.
+func NewRedisCommandsWithOptions(client redis.UniversalClient, options RedisCommandsOptions) *RedisCommands {
 	return &RedisCommands{
-		client: client,
+		client:  client,
+		options: options,
 	}
 }
 
+// Sets the id of the current node. It is stored in the keyspace, so it is kept
+// across the restarts of the server and the reloads of the library.
+// errors:
+// - ErrInvalidArgument: If the id is not valid.
+func (c *RedisCommands) SetCurrentNode(ctx context.Context, nodeId string) error {
+	return c.fcall(ctx, "set_current_node_key", []string{currentNodeKey}, nodeId).Err()
+}
+
+// Returns the id of the current node.
+// errors:
+// - ErrNoCurrentNode: If the id of the current node is not set.
+func (c *RedisCommands) GetCurrentNode(ctx context.Context) (string, error) {
+	return c.fcall(ctx, "get_current_node_key", []string{currentNodeKey}).Text()
+}
+
+// Deprecated: use SetCurrentNode.
 func (c *RedisCommands) Set_current_node_key(ctx context.Context, nodeId string) error {
-	return c.client.FCall(ctx, "set_current_node_key", []string{nodeId}).Err()
+	return c.SetCurrentNode(ctx, nodeId)
 }
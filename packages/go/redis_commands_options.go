@@ -0,0 +1,192 @@
+package redis_commands
+
+import "time"
+
+// The encoding of the session data streamed by OffloadSession.
+type OffloadEncoding int
+
+const (
+	// The session data is streamed as a sequence of json objects, that maps
+	// each key to its value by type. It supports strings, lists, sets, sorted
+	// sets and hashes with utf-8 values only.
+	OffloadEncodingJson OffloadEncoding = iota
+	// The session data is streamed as a sequence of binary records with the
+	// DUMP payload and the expiration time of each key. It supports any value
+	// byte for byte, but the onloading node must run a Redis version with a
+	// compatible RDB format.
+	OffloadEncodingDump
+)
+
+// The compression of the session data streamed by OffloadSession.
+type OffloadCompression int
+
+const (
+	// The session data is not compressed.
+	OffloadCompressionNone OffloadCompression = iota
+	// The session data is compressed with gzip.
+	OffloadCompressionGzip
+	// The session data is compressed with zstd, that is faster than gzip at a
+	// similar ratio.
+	OffloadCompressionZstd
+)
+
+// Options of the RedisCommands.
+type RedisCommandsOptions struct {
+	// The encoding of the offloaded session data.
+	offloadEncoding OffloadEncoding
+	// The compression of the offloaded session data.
+	offloadCompression OffloadCompression
+	// The target size in bytes of the chunks of offloaded session data.
+	offloadChunkSize int64
+	// The time to wait for the confirmation of an offload once its stream has
+	// been read, after which the offload is canceled.
+	offloadConfirmTimeout time.Duration
+	// Whether the sessions created or onloaded have the index of the keys of
+	// their data.
+	indexSessionKeys bool
+}
+
+// Builder for RedisCommandsOptions.
+type RedisCommandsOptionsBuilder struct {
+	options RedisCommandsOptions
+}
+
+// Create a new RedisCommandsOptionsBuilder.
+func NewRedisCommandsOptionsBuilder() *RedisCommandsOptionsBuilder {
+	return &RedisCommandsOptionsBuilder{
+		options: DefaultRedisCommandsOptions(),
+	}
+}
+
+// Set the offloadEncoding. The onload detects the encoding of the stream, so
+// nodes with different encodings can exchange sessions.
+func (builder *RedisCommandsOptionsBuilder) OffloadEncoding(offloadEncoding OffloadEncoding) *RedisCommandsOptionsBuilder {
+	builder.options.offloadEncoding = offloadEncoding
+	return builder
+}
+
+// Set the offloadCompression. The compression is recorded in the header of the
+// stream, so the onload decompresses it transparently.
+func (builder *RedisCommandsOptionsBuilder) OffloadCompression(offloadCompression OffloadCompression) *RedisCommandsOptionsBuilder {
+	builder.options.offloadCompression = offloadCompression
+	return builder
+}
+
+// Set the offloadChunkSize, that is the default target size in bytes of the
+// chunks of session data, that an offload can override with OffloadOptions.
+// Keys are added to a chunk until its size reaches the target, in the json
+// encoding big collections are split over multiple chunks while big strings may
+// exceed it. Values that are not positive are ignored.
+func (builder *RedisCommandsOptionsBuilder) OffloadChunkSize(offloadChunkSize int64) *RedisCommandsOptionsBuilder {
+	if offloadChunkSize > 0 {
+		builder.options.offloadChunkSize = offloadChunkSize
+	}
+	return builder
+}
+
+// Set the offloadConfirmTimeout, that is the default time that OffloadSession
+// waits for ConfirmSessionOffload once the stream has been read, after which
+// the offload is canceled and the session becomes active again, that an offload
+// can override with OffloadOptions. The timeout is a trade-off: an offload that
+// is confirmed after it, e.g. because the onloading node is slow, fails, while
+// the onloading node may have already activated the session, that is then
+// active on both nodes until one of them is deleted. It must exceed the time
+// the onloading node takes to onload the stream once read. Values that are not
+// positive are ignored.
+func (builder *RedisCommandsOptionsBuilder) OffloadConfirmTimeout(offloadConfirmTimeout time.Duration) *RedisCommandsOptionsBuilder {
+	if offloadConfirmTimeout > 0 {
+		builder.options.offloadConfirmTimeout = offloadConfirmTimeout
+	}
+	return builder
+}
+
+// Set the indexSessionKeys. The sessions created or onloaded afterwards keep
+// the index of the keys of their data, that offload, deletion and size
+// estimation iterate instead of scanning the whole keyspace. The index is kept
+// by SessionDataCommand, so the data of these sessions must be written only
+// through it, or their keys are not offloaded nor deleted. For this reason the
+// option is disabled by default, since the scan finds the keys however they
+// are written. The sessions keep the mode they had when they were created or
+// onloaded.
+func (builder *RedisCommandsOptionsBuilder) IndexSessionKeys(indexSessionKeys bool) *RedisCommandsOptionsBuilder {
+	builder.options.indexSessionKeys = indexSessionKeys
+	return builder
+}
+
+// Build the RedisCommandsOptions.
+func (builder *RedisCommandsOptionsBuilder) Build() RedisCommandsOptions {
+	return builder.options
+}
+
+// DefaultRedisCommandsOptions returns the default options of the RedisCommands.
+func DefaultRedisCommandsOptions() RedisCommandsOptions {
+	return RedisCommandsOptions{
+		offloadEncoding:       OffloadEncodingJson,
+		offloadCompression:    OffloadCompressionNone,
+		offloadChunkSize:      1 << 20,
+		offloadConfirmTimeout: 30 * time.Second,
+	}
+}
+
+// Options of a single offload, that complement api.OffloadSessionOptions with
+// the options specific to this store.
+type OffloadOptions struct {
+	// The target size in bytes of the chunks of offloaded session data, 0 to
+	// use the one of the RedisCommandsOptions.
+	chunkSize int64
+	// The time to wait for the confirmation of the offload once its stream has
+	// been read, 0 to use the one of the RedisCommandsOptions.
+	confirmTimeout time.Duration
+	// The compression of the offloaded session data, nil to use the one of the
+	// RedisCommandsOptions.
+	compression *OffloadCompression
+}
+
+// Builder for OffloadOptions.
+type OffloadOptionsBuilder struct {
+	options OffloadOptions
+}
+
+// Create a new OffloadOptionsBuilder.
+func NewOffloadOptionsBuilder() *OffloadOptionsBuilder {
+	return &OffloadOptionsBuilder{}
+}
+
+// Set the chunkSize, that is the target size in bytes of the chunks of session
+// data of the offload, in both encodings. Keys are added to a chunk until the
+// size of their serialized values reaches the target, at least one key is added
+// to each chunk. Values that are not positive are ignored.
+func (builder *OffloadOptionsBuilder) ChunkSize(chunkSize int64) *OffloadOptionsBuilder {
+	if chunkSize > 0 {
+		builder.options.chunkSize = chunkSize
+	}
+	return builder
+}
+
+// Set the confirmTimeout, that is the time that the offload waits for
+// ConfirmSessionOffload once its stream has been read, see
+// RedisCommandsOptionsBuilder.OffloadConfirmTimeout. Values that are not
+// positive are ignored.
+func (builder *OffloadOptionsBuilder) ConfirmTimeout(confirmTimeout time.Duration) *OffloadOptionsBuilder {
+	if confirmTimeout > 0 {
+		builder.options.confirmTimeout = confirmTimeout
+	}
+	return builder
+}
+
+// Set the compression of the session data of the offload, e.g. to skip the
+// compression of a session that is sent to a node on the same network. The
+// compression is recorded in the header of the stream, see
+// RedisCommandsOptionsBuilder.OffloadCompression. Unknown compressions are
+// ignored.
+func (builder *OffloadOptionsBuilder) Compression(compression OffloadCompression) *OffloadOptionsBuilder {
+	if _, ok := offloadCompressionNames[compression]; ok {
+		builder.options.compression = &compression
+	}
+	return builder
+}
+
+// Build the OffloadOptions.
+func (builder *OffloadOptionsBuilder) Build() OffloadOptions {
+	return builder.options
+}
@@ -0,0 +1,131 @@
+package redis_commands
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/ermes-labs/api-go/api"
+	"github.com/redis/go-redis/v9"
+)
+
+// The environment variable with the url of the Redis server used by the tests
+// that run the functions of the library, e.g. redis://localhost:6379/15. The
+// tests are skipped if it is not set. The database is flushed by every test,
+// so it must not hold any other data.
+const testRedisUrlEnv = "ERMES_TEST_REDIS_URL"
+
+// The id of the current node of the tests.
+const testNodeId = "test-node"
+
+// Returns a client of the Redis server of the tests, skipping the test if the
+// server is not configured.
+var newTestRedisClient = func(t *testing.T) redis.UniversalClient {
+	url := os.Getenv(testRedisUrlEnv)
+
+	if url == "" {
+		t.Skipf("%s is not set", testRedisUrlEnv)
+	}
+
+	options, err := redis.ParseURL(url)
+
+	if err != nil {
+		t.Fatalf("redis.ParseURL() error = %v", err)
+	}
+
+	return redis.NewClient(options)
+}
+
+// Returns a RedisCommands on an empty database, with the library loaded and the
+// current node set.
+func newTestRedisCommands(t *testing.T) (*RedisCommands, redis.UniversalClient) {
+	return newTestRedisCommandsWithOptions(t, DefaultRedisCommandsOptions())
+}
+
+// Returns a RedisCommands with the given options on an empty database, with the
+// library loaded and the current node set.
+func newTestRedisCommandsWithOptions(t *testing.T, options RedisCommandsOptions) (*RedisCommands, redis.UniversalClient) {
+	t.Helper()
+
+	ctx := context.Background()
+	client := newTestRedisClient(t)
+	t.Cleanup(func() { client.Close() })
+
+	if err := client.FlushDB(ctx).Err(); err != nil {
+		t.Fatalf("FlushDB() error = %v", err)
+	}
+
+	commands := NewRedisCommandsWithOptions(client, options)
+
+	if err := commands.EnsureLibrary(ctx); err != nil {
+		t.Fatalf("EnsureLibrary() error = %v", err)
+	}
+
+	if err := commands.SetCurrentNode(ctx, testNodeId); err != nil {
+		t.Fatalf("SetCurrentNode() error = %v", err)
+	}
+
+	return commands, client
+}
+
+// Offloads a session and returns the stream, leaving the offload pending.
+func offloadTestSession(t *testing.T, commands *RedisCommands, sessionId string, options OffloadOptions) []byte {
+	t.Helper()
+
+	reader, loader, err := commands.OffloadSessionWithOptions(context.Background(), sessionId, api.OffloadSessionOptions{}, options)
+
+	if err != nil {
+		t.Fatalf("OffloadSessionWithOptions() error = %v", err)
+	}
+
+	defer reader.Close()
+	go loader()
+
+	stream, err := io.ReadAll(reader)
+
+	if err != nil {
+		t.Fatalf("ReadAll() of the offload stream error = %v", err)
+	}
+
+	return stream
+}
+
+func TestCurrentNode(t *testing.T) {
+	ctx := context.Background()
+	commands, client := newTestRedisCommands(t)
+
+	if nodeId, err := commands.GetCurrentNode(ctx); err != nil || nodeId != testNodeId {
+		t.Fatalf("GetCurrentNode() = %q, %v, want %q", nodeId, err, testNodeId)
+	}
+
+	// The id is kept in the keyspace across the reloads of the library.
+	if err := client.FunctionLoadReplace(ctx, librarySource).Err(); err != nil {
+		t.Fatalf("FunctionLoadReplace() error = %v", err)
+	}
+
+	if nodeId, err := commands.GetCurrentNode(ctx); err != nil || nodeId != testNodeId {
+		t.Fatalf("GetCurrentNode() after a reload = %q, %v, want %q", nodeId, err, testNodeId)
+	}
+
+	if err := commands.Set_current_node_key(ctx, "other-node"); err != nil {
+		t.Fatalf("Set_current_node_key() error = %v", err)
+	}
+
+	if nodeId := client.Get(ctx, currentNodeKey).Val(); nodeId != "other-node" {
+		t.Fatalf("GET of the current node = %q, want %q", nodeId, "other-node")
+	}
+
+	for _, nodeId := range []string{"", "a:b"} {
+		if err := commands.SetCurrentNode(ctx, nodeId); !errors.Is(err, ErrInvalidArgument) {
+			t.Fatalf("SetCurrentNode(%q) error = %v, want %v", nodeId, err, ErrInvalidArgument)
+		}
+	}
+
+	client.Del(ctx, currentNodeKey)
+
+	if _, err := commands.GetCurrentNode(ctx); !errors.Is(err, ErrNoCurrentNode) {
+		t.Fatalf("GetCurrentNode() without a current node error = %v, want %v", err, ErrNoCurrentNode)
+	}
+}
@@ -2,6 +2,28 @@ package redis_commands
 
 import "fmt"
 
+// Prefix of the keys of the node, that are the sets that index the sessions of
+// the node, the configuration and the infrastructure. Its hash tag maps them to
+// the same slot of a Redis Cluster, while the keys of each session are tagged
+// with the session id (see sessionHashTag), so that the sessions are spread
+// over the shards of the cluster. The functions of the library touch either the
+// keys of a session or the keys of the node, so they are never cross-slot.
+const NodeKeysPrefix = "{ermes}:"
+
+// Prefixes of the key spaces of Ermes.
+const (
+	sessionKeySpacePrefix         = "s:"
+	nodeKeySpacePrefix            = NodeKeysPrefix + "n:"
+	sessionMetadataKeySpacePrefix = "m:"
+	configKeySpacePrefix          = NodeKeysPrefix + "c:"
+	infrastructureKeySpacePrefix  = NodeKeysPrefix + "i:"
+)
+
+// Returns the hash tag of the keys of a session.
+func sessionHashTag(sessionId string) string {
+	return "{" + sessionId + "}"
+}
+
 // Struct that contains all the public key spaces of Ermes.
 type PublicErmesKeySpaces struct {
 	Session keySpace
@@ -27,8 +49,8 @@ func NewPublicErmesKeySpaces(sessionId string) PublicErmesKeySpaces {
 	}
 
 	return PublicErmesKeySpaces{
-		Session: NewKeySpace("s:" + sessionId + ":"),
-		Node:    NewKeySpace("n:"),
+		Session: NewKeySpace(sessionKeySpacePrefix + sessionHashTag(sessionId) + ":"),
+		Node:    NewKeySpace(nodeKeySpacePrefix),
 	}
 }
 
@@ -36,7 +58,7 @@ func NewPublicErmesKeySpaces(sessionId string) PublicErmesKeySpaces {
 func NewPublicErmesKeySpaceWithoutSessionSpecificKeySpaces() PublicErmesKeySpaces {
 	return PublicErmesKeySpaces{
 		Session: panicUnsetSessionIdError,
-		Node:    NewKeySpace("n:"),
+		Node:    NewKeySpace(nodeKeySpacePrefix),
 	}
 }
 
@@ -47,8 +69,8 @@ func NewInternalErmesKeySpaces(sessionId string) InternalErmesKeySpaces {
 	}
 
 	return InternalErmesKeySpaces{
-		SessionMetadata: NewKeySpace("m:" + sessionId + ":"),
-		Config:          NewKeySpace("c:"),
+		SessionMetadata: NewKeySpace(sessionMetadataKeySpacePrefix + sessionHashTag(sessionId) + ":"),
+		Config:          NewKeySpace(configKeySpacePrefix),
 	}
 }
 
@@ -56,7 +78,7 @@ func NewInternalErmesKeySpaces(sessionId string) InternalErmesKeySpaces {
 func NewInternalErmesKeySpaceWithoutSessionSpecificKeySpaces() InternalErmesKeySpaces {
 	return InternalErmesKeySpaces{
 		SessionMetadata: panicUnsetSessionIdError,
-		Config:          NewKeySpace("c:"),
+		Config:          NewKeySpace(configKeySpacePrefix),
 	}
 }
 
@@ -111,3 +133,71 @@ func (keySpace *keySpace) Unwrap(key string) (string, error) {
 	// Remove the prefix from the key and return the unwrapped key.
 	return key[len(prefix):], nil
 }
+
+// Keys of the config key space used by the library.
+var (
+	currentNodeKey                = configKeySpacePrefix + "current_node"
+	sessionsIndexKey              = configKeySpacePrefix + "sessions_index"
+	sessionsSetKey                = configKeySpacePrefix + "sessions_set"
+	offloadableSessionsSetKey     = configKeySpacePrefix + "offloadable_sessions_set"
+	offloadedSessionsSetKey       = configKeySpacePrefix + "offloaded_sessions_set"
+	deletedSessionsSetKey         = configKeySpacePrefix + "deleted_sessions_set"
+	sessionsResourcesKey          = configKeySpacePrefix + "sessions_resources"
+	nodesGeosetKey                = configKeySpacePrefix + "nodes_geoset"
+	resourcesUsageKey             = configKeySpacePrefix + "resources_usage"
+	resourcesUsageSentKey         = configKeySpacePrefix + "resources_usage_sent"
+	resourcesUsagePendingKey      = configKeySpacePrefix + "resources_usage_pending"
+	resourcesUsageFullUpdateAtKey = configKeySpacePrefix + "resources_usage_full_update_at"
+)
+
+// Keys of the infrastructure key space used by the library, that map each node
+// to its json, to its parent and to the resources usage it reported.
+var (
+	infrastructureNodesKey   = infrastructureKeySpacePrefix + "nodes"
+	infrastructureParentsKey = infrastructureKeySpacePrefix + "parents"
+	infrastructureUsageKey   = infrastructureKeySpacePrefix + "usage"
+)
+
+// Returns the keys that hold the id and the resources usage of the current node,
+// followed by the given keys.
+func nodeUsageKeys(keys ...string) []string {
+	return append([]string{currentNodeKey, sessionsSetKey, offloadedSessionsSetKey, resourcesUsageKey}, keys...)
+}
+
+// Returns the keys of the index of the sessions of the node, followed by the
+// given keys.
+func sessionsIndexKeys(keys ...string) []string {
+	return append([]string{
+		sessionsIndexKey,
+		sessionsSetKey,
+		offloadableSessionsSetKey,
+		offloadedSessionsSetKey,
+		deletedSessionsSetKey,
+		sessionsResourcesKey,
+		resourcesUsageKey,
+	}, keys...)
+}
+
+// Returns the keys of the infrastructure, followed by the given keys.
+func infrastructureKeys(keys ...string) []string {
+	return append([]string{nodesGeosetKey, infrastructureNodesKey, infrastructureParentsKey, infrastructureUsageKey}, keys...)
+}
+
+// Returns the key of the metadata of a session.
+func sessionMetadataKey(sessionId string) string {
+	return sessionMetadataKeySpacePrefix + sessionHashTag(sessionId) + ":metadata"
+}
+
+// Returns the key of a key of the session data.
+func sessionDataKey(sessionId string, key string) string {
+	return sessionKeySpacePrefix + sessionHashTag(sessionId) + ":" + key
+}
+
+// Returns the keys of a session, that are the keys declared by the functions on
+// a session, followed by the given keys of the session data.
+func sessionKeys(sessionId string, dataKeys ...string) []string {
+	return append([]string{
+		sessionMetadataKey(sessionId),
+		sessionMetadataKeySpacePrefix + sessionHashTag(sessionId) + ":keys",
+	}, dataKeys...)
+}
@@ -0,0 +1,270 @@
+package redis_commands
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/ermes-labs/api-go/api"
+	"github.com/redis/go-redis/v9"
+)
+
+// The number of keys of the session data scanned by a single call.
+const sessionDataScanCount = 100
+
+// Calls a function of the ermeslib library that changes the state of a
+// session, then syncs the entry of the session in the index of the node. The
+// function and the read of the entry run in a single transaction on the slot of
+// the session, while the sync runs on the slot of the node, so the index may
+// lag behind the session in between. Syncs are ordered by the version of the
+// entry, so an entry that is synced late never overwrites a newer one. An
+// error of the sync is returned by the command.
+func (c *RedisCommands) fcallSession(
+	ctx context.Context,
+	function string,
+	sessionId string,
+	keys []string,
+	args ...interface{},
+) *redis.Cmd {
+	var cmd, entry *redis.Cmd
+
+	// The error is the one of the first failed command, that is read below.
+	_, _ = c.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		cmd = pipe.FCall(ctx, function, keys, args...)
+		entry = pipe.FCall(ctx, "get_session_index_entry", sessionKeys(sessionId), sessionId)
+		return nil
+	})
+
+	if err := cmd.Err(); err != nil {
+		cmd.SetErr(translateError(err))
+	}
+
+	if err := entry.Err(); err != nil {
+		if cmd.Err() == nil {
+			cmd.SetErr(translateError(err))
+		}
+		return cmd
+	}
+
+	// The function may have changed the session even if it failed.
+	if err := c.syncSessionIndex(ctx, sessionId, entry.Val()); err != nil && cmd.Err() == nil {
+		cmd.SetErr(err)
+	}
+
+	return cmd
+}
+
+// Syncs the entry of a session in the index of the node, as returned by
+// get_session_index_entry or by the deletion of the session. Empty entries,
+// that are the ones of the sessions that do not exist, are skipped.
+func (c *RedisCommands) syncSessionIndex(ctx context.Context, sessionId string, entry interface{}) error {
+	if entry, ok := entry.(string); ok && entry != "" {
+		return c.fcall(ctx, "sync_session_index", sessionsIndexKeys(), sessionId, entry).Err()
+	}
+
+	return nil
+}
+
+// Scans the keys of the session data, starting from the cursor ("" or "0" to
+// start). It returns the next cursor, that is "0" once the scan is completed,
+// and the keys, that are the full keys to declare to the functions that read or
+// delete the session data.
+// errors:
+// - ErrSessionNotFound: If no session with the given id is found.
+func (c *RedisCommands) scanSessionData(
+	ctx context.Context,
+	sessionId string,
+	cursor string,
+) (string, []string, error) {
+	res, err := c.fcall(ctx, "scan_session_data", sessionKeys(sessionId), sessionId, cursor, sessionDataScanCount).Slice()
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	return res[0].(string), toStringSlice(res[1]), nil
+}
+
+// Deletes a chunk of the data of a session that has been marked as DELETING,
+// starting from the scan cursor ("0" to start). It returns the next cursor,
+// that is empty once the session has been completely deleted and synced in the
+// index of the node, and the number of deleted keys. A session that has been
+// deleted in the meanwhile (e.g. by the garbage collector) is not an error.
+func (c *RedisCommands) deleteSessionChunk(
+	ctx context.Context,
+	sessionId string,
+	cursor string,
+) (string, int64, error) {
+	next, keys, err := c.scanSessionData(ctx, sessionId, cursor)
+
+	if errors.Is(err, api.ErrSessionNotFound) {
+		return "", 0, nil
+	}
+
+	if err != nil {
+		return "", 0, err
+	}
+
+	final := next == "0"
+	res, err := c.fcall(ctx, "delete_chunk", sessionKeys(sessionId, keys...), sessionId, formatFlag(final)).Slice()
+
+	if errors.Is(err, api.ErrSessionNotFound) {
+		return "", 0, nil
+	}
+
+	if err != nil {
+		return "", 0, err
+	}
+
+	// The session has been completely deleted.
+	if final {
+		return "", res[0].(int64), c.syncSessionIndex(ctx, sessionId, res[1])
+	}
+
+	return next, res[0].(int64), nil
+}
+
+// Deletes the data of a session that has been marked as DELETING, chunk by
+// chunk, then syncs the deleted session in the index of the node.
+func (c *RedisCommands) deleteSessionData(ctx context.Context, sessionId string) error {
+	for cursor := "0"; cursor != ""; {
+		var err error
+		if cursor, _, err = c.deleteSessionChunk(ctx, sessionId, cursor); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// The number of keys scanned by a single call of the repair of the index.
+const sessionsIndexRepairScanCount = 1000
+
+// Statistics about a repair of the index of the sessions of the node.
+type RepairSessionsIndexStats struct {
+	// The number of entries synced with the metadata of their session.
+	Synced int64
+	// The number of entries removed, whose session does not exist anymore.
+	Removed int64
+}
+
+// RepairSessionsIndex syncs the index of the sessions of the node with the
+// metadata of the sessions. A function on a session and the sync of its entry
+// are separate calls (see fcallSession), so if the sync is lost, e.g. because
+// the client fails in between, the entry, the sets of the node and its
+// resources usage are stale until the next change of the session. Sessions
+// without expiration are never visited by the garbage collection, so they are
+// repaired only by this function. It scans the whole keyspace, so it is meant
+// to be run periodically or after a failure, not on every request.
+func (c *RedisCommands) RepairSessionsIndex(ctx context.Context) (RepairSessionsIndexStats, error) {
+	var stats RepairSessionsIndexStats
+	var err error
+
+	// The metadata of the sessions is spread over the masters of a cluster.
+	if cluster, ok := c.client.(*redis.ClusterClient); ok {
+		err = cluster.ForEachMaster(ctx, func(ctx context.Context, client *redis.Client) error {
+			return c.syncSessionsMetadata(ctx, client, &stats)
+		})
+	} else {
+		err = c.syncSessionsMetadata(ctx, c.client, &stats)
+	}
+
+	if err != nil {
+		return stats, err
+	}
+
+	return stats, c.removeDeletedSessionsEntries(ctx, &stats)
+}
+
+// Syncs the entries of the sessions whose metadata is on the given server.
+func (c *RedisCommands) syncSessionsMetadata(ctx context.Context, client redis.Cmdable, stats *RepairSessionsIndexStats) error {
+	prefix, suffix, _ := strings.Cut(sessionMetadataKey("*"), "*")
+
+	for cursor := uint64(0); ; {
+		keys, next, err := client.Scan(ctx, cursor, sessionMetadataKey("*"), sessionsIndexRepairScanCount).Result()
+
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			sessionId := strings.TrimSuffix(strings.TrimPrefix(key, prefix), suffix)
+			entry, err := c.fcall(ctx, "get_session_index_entry", sessionKeys(sessionId), sessionId).Text()
+
+			if err != nil {
+				return err
+			}
+
+			// The session has been deleted in the meanwhile.
+			if entry == "" {
+				continue
+			}
+
+			synced, err := c.fcall(ctx, "sync_session_index", sessionsIndexKeys(), sessionId, entry).Int64()
+
+			if err != nil {
+				return err
+			}
+
+			atomic.AddInt64(&stats.Synced, synced)
+		}
+
+		if cursor = next; cursor == 0 {
+			return nil
+		}
+	}
+}
+
+// Removes the entries of the index whose session does not exist anymore, that
+// have not been synced with the deletion of the session.
+func (c *RedisCommands) removeDeletedSessionsEntries(ctx context.Context, stats *RepairSessionsIndexStats) error {
+	for cursor := uint64(0); ; {
+		pairs, next, err := c.client.HScan(ctx, sessionsIndexKey, cursor, "", sessionsIndexRepairScanCount).Result()
+
+		if err != nil {
+			return err
+		}
+
+		for i := 0; i+1 < len(pairs); i += 2 {
+			sessionId := pairs[i]
+
+			var entry struct {
+				State   string `json:"state"`
+				Version string `json:"version"`
+			}
+			if err := json.Unmarshal([]byte(pairs[i+1]), &entry); err != nil || entry.State == "DELETED" {
+				continue
+			}
+
+			exists, err := c.client.Exists(ctx, sessionMetadataKey(sessionId)).Result()
+
+			if err != nil {
+				return err
+			}
+
+			if exists == 1 {
+				continue
+			}
+
+			// The deletion is versioned after the stale entry, so that it is
+			// superseded by the sync of a session created in the meanwhile.
+			version, _ := strconv.ParseInt(entry.Version, 10, 64)
+			deleted := fmt.Sprintf(`{"state":"DELETED","version":"%d"}`, version+1)
+			removed, err := c.fcall(ctx, "sync_session_index", sessionsIndexKeys(), sessionId, deleted).Int64()
+
+			if err != nil {
+				return err
+			}
+
+			stats.Removed += removed
+		}
+
+		if cursor = next; cursor == 0 {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package redis_commands
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ermes-labs/api-go/api"
+)
+
+func TestRepairSessionsIndex(t *testing.T) {
+	ctx := context.Background()
+	commands, client := newTestRedisCommands(t)
+
+	unsynced, err := commands.CreateSession(ctx, api.DefaultCreateSessionOptions())
+
+	if err != nil {
+		t.Fatalf("CreateSession() error = %v", err)
+	}
+
+	deleted, err := commands.CreateSession(ctx, api.DefaultCreateSessionOptions())
+
+	if err != nil {
+		t.Fatalf("CreateSession() error = %v", err)
+	}
+
+	// The sync of the creation of a session is lost.
+	client.HDel(ctx, sessionsIndexKey, unsynced)
+	client.ZRem(ctx, sessionsSetKey, unsynced)
+	client.ZRem(ctx, offloadableSessionsSetKey, unsynced)
+	// The sync of the deletion of a session is lost.
+	client.Del(ctx, sessionMetadataKey(deleted))
+
+	stats, err := commands.RepairSessionsIndex(ctx)
+
+	if err != nil {
+		t.Fatalf("RepairSessionsIndex() error = %v", err)
+	}
+
+	if want := (RepairSessionsIndexStats{Synced: 1, Removed: 1}); stats != want {
+		t.Fatalf("RepairSessionsIndex() = %+v, want %+v", stats, want)
+	}
+
+	for _, key := range []string{sessionsSetKey, offloadableSessionsSetKey} {
+		if err := client.ZScore(ctx, key, unsynced).Err(); err != nil {
+			t.Errorf("ZScore(%s, unsynced) error = %v, want the session in the set", key, err)
+		}
+
+		if err := client.ZScore(ctx, key, deleted).Err(); err == nil {
+			t.Errorf("ZScore(%s, deleted) error = nil, want the session removed from the set", key)
+		}
+	}
+
+	if err := client.ZScore(ctx, deletedSessionsSetKey, deleted).Err(); err != nil {
+		t.Errorf("ZScore(%s, deleted) error = %v, want the session in the set", deletedSessionsSetKey, err)
+	}
+
+	// The repair of a synced index changes nothing.
+	if stats, err := commands.RepairSessionsIndex(ctx); err != nil || stats != (RepairSessionsIndexStats{}) {
+		t.Fatalf("RepairSessionsIndex() of a synced index = %+v, %v, want no changes", stats, err)
+	}
+}
@@ -0,0 +1,64 @@
+package redis_commands
+
+import (
+	"context"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Runs a command on a key of the session data, given without the prefix of the
+// session key space, and returns its reply. The command must take the key as
+// its first argument and no other key, e.g. SET, HSET, RPUSH, DEL or EXPIRE.
+// If the session is indexed (see RedisCommandsOptionsBuilder.IndexSessionKeys)
+// the index of its keys is updated in the same call, so that it is never out
+// of sync with the session data.
+// errors:
+// - ErrSessionNotFound: If no session with the given id is found.
+// - ErrInvalidSessionState: If the session is not active.
+func (c *RedisCommands) SessionDataCommand(
+	ctx context.Context,
+	sessionId string,
+	command string,
+	key string,
+	args ...interface{},
+) *redis.Cmd {
+	fcallArgs := make([]interface{}, 0, 3+len(args))
+	fcallArgs = append(fcallArgs, sessionId, command, key)
+	fcallArgs = append(fcallArgs, args...)
+
+	return c.fcall(ctx, "session_data_command", sessionKeys(sessionId, sessionDataKey(sessionId, key)), fcallArgs...)
+}
+
+// Estimates the memory used by the data of a session, as reported by MEMORY
+// USAGE. The function returns the bytes used and the number of keys of the
+// session data.
+// errors:
+// - ErrSessionNotFound: If no session with the given id is found.
+func (c *RedisCommands) EstimateSessionSize(
+	ctx context.Context,
+	sessionId string,
+) (bytes int64, keys int64, err error) {
+	cursor := "0"
+
+	for {
+		next, dataKeys, err := c.scanSessionData(ctx, sessionId, cursor)
+
+		if err != nil {
+			return 0, 0, err
+		}
+
+		res, err := c.fcall(ctx, "estimate_session_size", sessionKeys(sessionId, dataKeys...), sessionId).Slice()
+
+		if err != nil {
+			return 0, 0, err
+		}
+
+		bytes += res[0].(int64)
+		keys += res[1].(int64)
+
+		// The session data has been completely estimated.
+		if cursor = next; cursor == "0" {
+			return bytes, keys, nil
+		}
+	}
+}
@@ -2,8 +2,11 @@ package redis_commands
 
 import (
 	"context"
+	"fmt"
+	"strconv"
 
 	"github.com/ermes-labs/api-go/api"
+	"github.com/ermes-labs/api-go/infrastructure"
 )
 
 // Returns the metadata associated with a session.
@@ -13,16 +16,151 @@ func (c *RedisCommands) GetSessionMetadata(
 	ctx context.Context,
 	sessionId string,
 ) (api.SessionMetadata, error) {
-	return api.SessionMetadata{}, nil
+	res, err := c.fcall(ctx, "get_session_metadata", sessionKeys(sessionId), sessionId).StringSlice()
+
+	if err != nil {
+		return api.SessionMetadata{}, err
+	}
+
+	return parseSessionMetadata(res)
 }
 
-// SetClientCoordinates sets the coordinates of the client of a session.
+// SetSessionMetadata sets the coordinates of the client and the expiration
+// time of a session, both in a single step. Options that are not set leave the
+// corresponding metadata unchanged, the session must exist even if no option
+// is set.
 // errors:
 // - ErrSessionNotFound: If no session with the given id is found.
+// - ErrInvalidArgument: If the coordinates or the expiration time are not valid.
+// - ErrIncompatibleOptions: If the options cannot be read.
 func (c *RedisCommands) SetSessionMetadata(
 	ctx context.Context,
 	sessionId string,
 	opt api.SessionMetadataOptions,
 ) error {
-	return nil
+	coordinates, err := clientGeoCoordinates(opt)
+	if err != nil {
+		return err
+	}
+
+	expiresAt, err := sessionExpiresAt(opt)
+	if err != nil {
+		return err
+	}
+
+	// The "expired" option takes precedence over the expiration time.
+	expired, err := sessionExpired(opt)
+	if err != nil {
+		return err
+	}
+
+	latitude, longitude := formatGeoCoordinates(coordinates)
+
+	return c.fcallSession(ctx, "set_session_metadata", sessionId, sessionKeys(sessionId),
+		sessionId,
+		formatFlag(coordinates != nil),
+		latitude,
+		longitude,
+		formatFlag(expiresAt != nil || expired),
+		formatUnixTimestamp(expiresAt),
+		formatFlag(expired)).Err()
+}
+
+// Parse the metadata of a session returned by the ermeslib functions, that is
+// the latitude and longitude of the client, the creating node, the creation,
+// update and expiration times.
+func parseSessionMetadata(fields []string) (api.SessionMetadata, error) {
+	if len(fields) < 6 {
+		return api.SessionMetadata{}, fmt.Errorf("%w: expected 6 metadata fields, got %d", ErrUnexpectedReply, len(fields))
+	}
+
+	latitude, longitude, createdIn, createdAt, updatedAt, expiresAt :=
+		fields[0], fields[1], fields[2], fields[3], fields[4], fields[5]
+
+	metadata := api.SessionMetadata{
+		CreatedIn: createdIn,
+	}
+
+	var err error
+	if metadata.ClientGeoCoordinates, err = parseGeoCoordinates(latitude, longitude); err != nil {
+		return api.SessionMetadata{}, err
+	}
+
+	if metadata.CreatedAt, err = strconv.ParseInt(createdAt, 10, 64); err != nil {
+		return api.SessionMetadata{}, err
+	}
+
+	if metadata.UpdatedAt, err = strconv.ParseInt(updatedAt, 10, 64); err != nil {
+		return api.SessionMetadata{}, err
+	}
+
+	if metadata.ExpiresAt, err = parseUnixTimestamp(expiresAt); err != nil {
+		return api.SessionMetadata{}, err
+	}
+
+	return metadata, nil
+}
+
+// Format the geo coordinates as stored in the session metadata, empty strings
+// if the coordinates are nil.
+func formatGeoCoordinates(coordinates *infrastructure.GeoCoordinates) (latitude string, longitude string) {
+	if coordinates == nil {
+		return "", ""
+	}
+
+	return strconv.FormatFloat(coordinates.Latitude, 'f', 6, 64),
+		strconv.FormatFloat(coordinates.Longitude, 'f', 6, 64)
+}
+
+// Format a Unix timestamp as stored in the session metadata, an empty string if
+// the timestamp is nil.
+func formatUnixTimestamp(timestamp *int64) string {
+	if timestamp == nil {
+		return ""
+	}
+
+	return strconv.FormatInt(*timestamp, 10)
+}
+
+// Format a flag of the ermeslib functions, "1" if it is set and "0" otherwise.
+func formatFlag(flag bool) string {
+	if flag {
+		return "1"
+	}
+
+	return "0"
+}
+
+// Parse the geo coordinates stored in the session metadata, nil if they are
+// not set.
+func parseGeoCoordinates(latitude string, longitude string) (*infrastructure.GeoCoordinates, error) {
+	if latitude == "" || longitude == "" {
+		return nil, nil
+	}
+
+	lat, err := strconv.ParseFloat(latitude, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	long, err := strconv.ParseFloat(longitude, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	return &infrastructure.GeoCoordinates{Latitude: lat, Longitude: long}, nil
+}
+
+// Parse a Unix timestamp stored in the session metadata, nil if it is not set.
+func parseUnixTimestamp(timestamp string) (*int64, error) {
+	if timestamp == "" {
+		return nil, nil
+	}
+
+	value, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	return &value, nil
 }
@@ -0,0 +1,32 @@
+package redis_commands
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ermes-labs/api-go/api"
+)
+
+func TestParseSessionMetadataShortReply(t *testing.T) {
+	if _, err := parseSessionMetadata([]string{"", ""}); !errors.Is(err, ErrUnexpectedReply) {
+		t.Fatalf("parseSessionMetadata() error = %v, want %v", err, ErrUnexpectedReply)
+	}
+}
+
+func TestSetSessionMetadataNotFound(t *testing.T) {
+	ctx := context.Background()
+	commands, _ := newTestRedisCommands(t)
+
+	for name, opt := range map[string]api.SessionMetadataOptions{
+		"no options": api.NewSessionMetadataOptionsBuilder().Build(),
+		"expiration": api.NewSessionMetadataOptionsBuilder().UnixExpiresAt(time.Now().Unix() + 3600).Build(),
+	} {
+		t.Run(name, func(t *testing.T) {
+			if err := commands.SetSessionMetadata(ctx, "missing", opt); !errors.Is(err, api.ErrSessionNotFound) {
+				t.Fatalf("SetSessionMetadata() error = %v, want %v", err, api.ErrSessionNotFound)
+			}
+		})
+	}
+}
@@ -53,8 +53,8 @@ func main() {
 	// 	log.Fatal(err)
 	// }
 
-	// Watch the specific script.lua file located one directory up
-	err = watcher.Add("../ermeslib.lua")
+	// Watch the lua library embedded in the go package
+	err = watcher.Add("../packages/go/ermeslib.lua")
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -85,7 +85,7 @@ func runTests() {
 
 func runInitScript() {
 	// Read the content of the Lua script file
-	luaScript, err := os.ReadFile("../ermeslib.lua")
+	luaScript, err := os.ReadFile("../packages/go/ermeslib.lua")
 	if err != nil {
 		panic(err) // Handle error appropriately
 	}